@@ -0,0 +1,70 @@
+// dbmigrate 执行目录中的SQL迁移，连接参数从环境变量读取，见dbx.DBConfig
+//
+//	go run ./dbx/cmd/dbmigrate -dir ./migrations up
+//	go run ./dbx/cmd/dbmigrate -dir ./migrations up -to 3 -dry-run
+//	go run ./dbx/cmd/dbmigrate -dir ./migrations down -steps 1
+//	go run ./dbx/cmd/dbmigrate -dir ./migrations status
+//
+// 未设置-driver与DATABASE_URL时使用Postgres，连接参数为DB_HOST、DB_PORT等
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/envx"
+	"k8s.io/klog/v2"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	dir := flag.String("dir", "migrations", "directory of <version>_<name>.up.sql and .down.sql files")
+	table := flag.String("table", "schema_migration", "migration history table")
+	driver := flag.String("driver", "", "postgres, mysql or sqlite, chosen by DATABASE_URL if empty, postgres if neither is set")
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	cfg := &dbx.DBConfig{}
+	envx.MustLoadEnv(cfg)
+	// 迁移由命令执行，不在连接时自动执行
+	cfg.DBInit = false
+	cfg.DBTelemetry = false
+
+	m := dbx.NewMigrator(dbx.WithMigrationTable(*table))
+	if err := m.AddFS(os.DirFS(*dir), "."); err != nil {
+		klog.Fatalf("failed to load migrations: %v", err)
+	}
+	var provider dbx.DBProvider
+	switch *driver {
+	case "":
+		if cfg.DBUrl == "" {
+			// 与DBConfig的默认值(DB_PORT=5432、DB_USER=postgres)一致
+			klog.Info("neither -driver nor DATABASE_URL is set, using postgres with DB_* settings")
+			provider = dbx.PostgresProvider
+		}
+	case "postgres":
+		provider = dbx.PostgresProvider
+	case "mysql":
+		provider = dbx.MySQLProvider
+	case "sqlite":
+		provider = dbx.SQLiteProvider
+	default:
+		klog.Fatalf("unsupported driver %s", *driver)
+	}
+	helper := &dbx.GormHelper{}
+	if err := helper.Open(cfg, provider); err != nil {
+		klog.Fatalf("failed to connect db: %v", err)
+	}
+	defer helper.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := dbx.MigrateCommand(ctx, helper.DB(), m, flag.Args(), os.Stdout); err != nil {
+		klog.Errorf("migrate: %v", err)
+		stop()
+		helper.Close()
+		os.Exit(1)
+	}
+}
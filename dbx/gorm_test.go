@@ -2,17 +2,23 @@ package dbx
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/duke-git/lancet/v2/random"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	otelTrace "go.opentelemetry.io/otel/trace"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/uptrace/opentelemetry-go-extra/otelgorm"
 	"github.com/uptrace/uptrace-go/uptrace"
 	"go.opentelemetry.io/otel"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
 type simpleTable struct {
@@ -83,3 +89,143 @@ func TestOpel(t *testing.T) {
 	t.Logf("testingKey value: %s", readData.Value)
 	ch.End()
 }
+
+func TestGormHelperOpen(t *testing.T) {
+	helper := &GormHelper{}
+	cfg := &DBConfig{DBUrl: "sqlite::memory:", DBMaxOpenConns: 20}
+	if err := helper.Open(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Close()
+	if n := helper.sqlDB.Stats().MaxOpenConnections; n != 1 {
+		t.Fatalf("expect sqlite to use a single connection, got %d", n)
+	}
+	if err := helper.DB().AutoMigrate(&simpleTable{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.DB().Create(&simpleTable{Key: "k", Value: "v"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	if err := helper.DB().Model(&simpleTable{}).Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("unexpected count %d: %v", count, err)
+	}
+}
+
+func TestSetupPool(t *testing.T) {
+	sqlDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	setupPool(sqlDB, "postgres", &DBConfig{DBMaxOpenConns: 5})
+	if n := sqlDB.Stats().MaxOpenConnections; n != 5 {
+		t.Fatalf("unexpected max open connections: %d", n)
+	}
+	// 未设置时保持原值，不会被设置为0
+	setupPool(sqlDB, "postgres", &DBConfig{})
+	if n := sqlDB.Stats().MaxOpenConnections; n != 5 {
+		t.Fatalf("unset pool config should be ignored, got %d", n)
+	}
+}
+
+func TestGormHelperReplicas(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdkTrace.NewTracerProvider(sdkTrace.WithSpanProcessor(recorder)))
+
+	dir := t.TempDir()
+	replicaPath := filepath.Join(dir, "replica.db")
+	replicaDB, err := gorm.Open(sqlite.Open(replicaPath), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replicaDB.AutoMigrate(&simpleTable{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicaDB.Create(&simpleTable{Key: "k", Value: "replica"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	helper := &GormHelper{}
+	cfg := &DBConfig{
+		DBUrl:                  "sqlite:" + filepath.Join(dir, "primary.db"),
+		DBTelemetry:            true,
+		DBReplicas:             []string{"sqlite:" + replicaPath},
+		DBReplicaCheckInterval: time.Millisecond * 50,
+	}
+	if err := helper.Open(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Close()
+	if status := helper.Replicas(); len(status) != 1 || !status[0].Healthy || status[0].Name != replicaPath {
+		t.Fatalf("unexpected replica status %+v", status)
+	}
+	if err := helper.DB().AutoMigrate(&simpleTable{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.DB().Create(&simpleTable{Key: "k", Value: "primary"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(db *gorm.DB) string {
+		var row simpleTable
+		if err := db.Where("key = ?", "k").Take(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+		return row.Value
+	}
+	if v := read(helper.DBWithCtx(ctx)); v != "replica" {
+		t.Fatalf("expect read from replica, got %s", v)
+	}
+	if v := read(helper.Primary()); v != "primary" {
+		t.Fatalf("expect Primary to read from primary, got %s", v)
+	}
+	if v := read(helper.DBWithCtx(WithPrimary(ctx))); v != "primary" {
+		t.Fatalf("expect WithPrimary to read from primary, got %s", v)
+	}
+	var rows []simpleTable
+	if err := helper.DB().Raw("SELECT * FROM simple_table WHERE key = ?", "k").Find(&rows).Error; err != nil || len(rows) != 1 || rows[0].Value != "replica" {
+		t.Fatalf("expect raw select from replica, got %v: %v", rows, err)
+	}
+	var value string
+	if err := helper.DB().Raw("SELECT value FROM simple_table WHERE key = ?", "k").Scan(&value).Error; err != nil || value != "primary" {
+		t.Fatalf("expect raw scan from primary, got %s: %v", value, err)
+	}
+	err = helper.DB().Transaction(func(tx *gorm.DB) error {
+		if v := read(tx); v != "primary" {
+			t.Errorf("expect transaction to read from primary, got %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := make(map[string]int)
+	for _, span := range recorder.Ended() {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "db.node" {
+				nodes[attr.Value.AsString()]++
+			}
+		}
+	}
+	if nodes["primary"] == 0 || nodes[replicaPath] != 2 {
+		t.Fatalf("unexpected node tags %v", nodes)
+	}
+
+	// 不健康的从库被剔除，查询回到主库
+	_ = helper.resolver.replicas[0].sqlDB.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for helper.Replicas()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("expect replica to become unhealthy")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if v := read(helper.DB()); v != "primary" {
+		t.Fatalf("expect fallback to primary, got %s", v)
+	}
+}
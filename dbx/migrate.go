@@ -0,0 +1,546 @@
+package dbx
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"io"
+	"io/fs"
+	"k8s.io/klog/v2"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	ErrMigrationLocked   = errors.New("dbx: migration lock held by another instance")
+	ErrMigrationLockLost = errors.New("dbx: migration lock lost")
+	ErrMigrationNoDown   = errors.New("dbx: migration has no down step")
+	ErrMigrationNotFound = errors.New("dbx: applied migration not registered")
+)
+
+// Migration 一个版本的迁移，Up/Down为Go函数或SQL，同时设置时优先使用函数
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	UpSQL   string
+	DownSQL string
+}
+
+func (m *Migration) hasDown() bool {
+	return m.Down != nil || m.DownSQL != ""
+}
+
+func (m *Migration) run(tx *gorm.DB, up bool) error {
+	fn, sql := m.Up, m.UpSQL
+	if !up {
+		fn, sql = m.Down, m.DownSQL
+	}
+	if fn != nil {
+		return fn(tx)
+	}
+	if sql == "" {
+		return nil
+	}
+	return tx.Exec(sql).Error
+}
+
+// SchemaMigration 已执行的迁移记录
+type SchemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// schemaMigrationLock 跨副本的迁移锁，只有一行
+type schemaMigrationLock struct {
+	Id          int `gorm:"primaryKey;autoIncrement:false"`
+	Owner       string
+	LockedUntil time.Time
+}
+
+// MigrationStatus 迁移的执行状态，AppliedAt为nil时未执行
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+	// Missing 已执行但没有注册，通常是回滚了代码
+	Missing bool
+}
+
+type migratorOptions struct {
+	table       string
+	lockTTL     time.Duration
+	lockTimeout time.Duration
+	owner       string
+}
+
+type MigratorOption func(options *migratorOptions)
+
+// WithMigrationTable 迁移记录表名，锁表为其加上_lock后缀，默认schema_migration
+func WithMigrationTable(table string) MigratorOption {
+	return func(options *migratorOptions) {
+		options.table = table
+	}
+}
+
+// WithMigrationLockTimeout 等待其他副本完成迁移的最长时间，默认5分钟
+func WithMigrationLockTimeout(timeout time.Duration) MigratorOption {
+	return func(options *migratorOptions) {
+		options.lockTimeout = timeout
+	}
+}
+
+// WithMigrationLockTTL 锁的有效期，持有期间自动续期，持有者崩溃时在有效期后释放，默认1分钟
+func WithMigrationLockTTL(ttl time.Duration) MigratorOption {
+	return func(options *migratorOptions) {
+		options.lockTTL = ttl
+	}
+}
+
+// Migrator 按版本顺序执行迁移，每个迁移与其记录在同一个事务中，配置了从库时只读写主库
+// 多个副本同时启动时通过锁表保证只有一个执行迁移，其他副本等待后发现已无待执行的迁移
+type Migrator struct {
+	migrations []Migration
+	opt        *migratorOptions
+}
+
+func NewMigrator(option ...MigratorOption) *Migrator {
+	hostname, _ := os.Hostname()
+	opt := &migratorOptions{
+		table:       "schema_migration",
+		lockTTL:     time.Minute,
+		lockTimeout: time.Minute * 5,
+		owner:       fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano()),
+	}
+	for _, o := range option {
+		o(opt)
+	}
+	return &Migrator{opt: opt}
+}
+
+// Add 注册迁移，版本号重复时返回错误
+func (m *Migrator) Add(migrations ...Migration) error {
+	for _, migration := range migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("dbx: invalid migration version %d", migration.Version)
+		}
+		for _, exist := range m.migrations {
+			if exist.Version == migration.Version {
+				return fmt.Errorf("dbx: duplicate migration version %d", migration.Version)
+			}
+		}
+		m.migrations = append(m.migrations, migration)
+	}
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+	return nil
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// AddFS 注册目录中的SQL迁移，文件名为<版本>_<名称>.up.sql与<版本>_<名称>.down.sql
+// 整个文件作为一次Exec执行，MySQL包含多条语句时需要在连接参数中开启multiStatements
+func (m *Migrator) AddFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	found := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		migration, ok := found[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			found[version] = migration
+		} else if migration.Name != match[2] {
+			return fmt.Errorf("dbx: migration version %d has different names: %s, %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.UpSQL = string(data)
+		} else {
+			migration.DownSQL = string(data)
+		}
+	}
+	for _, migration := range found {
+		if migration.UpSQL == "" {
+			return fmt.Errorf("dbx: migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+		if err := m.Add(*migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) history(db *gorm.DB) *gorm.DB {
+	return db.Table(m.opt.table)
+}
+
+func (m *Migrator) prepare(db *gorm.DB) error {
+	if err := m.history(db).AutoMigrate(&SchemaMigration{}); err != nil {
+		return err
+	}
+	return db.Table(m.opt.table + "_lock").AutoMigrate(&schemaMigrationLock{})
+}
+
+func (m *Migrator) applied(db *gorm.DB) (map[int64]SchemaMigration, error) {
+	var records []SchemaMigration
+	if err := m.history(db).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]SchemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Status 所有已注册与已执行的迁移，按版本排序
+func (m *Migrator) Status(ctx context.Context, db *gorm.DB) ([]MigrationStatus, error) {
+	db = db.WithContext(WithPrimary(ctx))
+	if err := m.prepare(db); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var status []MigrationStatus
+	for _, migration := range m.migrations {
+		s := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			s.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+		status = append(status, s)
+	}
+	for _, record := range applied {
+		record := record
+		status = append(status, MigrationStatus{Version: record.Version, Name: record.Name, AppliedAt: &record.AppliedAt, Missing: true})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+	return status, nil
+}
+
+// Up 执行版本不大于to的待执行迁移，to为0时执行全部，返回本次执行的迁移
+func (m *Migrator) Up(ctx context.Context, db *gorm.DB, to int64) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, db, func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if to > 0 && migration.Version > to {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := context.Cause(db.Statement.Context); err != nil {
+				return err
+			}
+			if err := m.apply(db, migration, true); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down 按版本倒序回滚最近执行的steps个迁移，返回本次回滚的迁移
+func (m *Migrator) Down(ctx context.Context, db *gorm.DB, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, db, func(db *gorm.DB) error {
+		var records []SchemaMigration
+		if err := m.history(db).Order("version desc").Limit(steps).Find(&records).Error; err != nil {
+			return err
+		}
+		for _, record := range records {
+			migration := m.find(record.Version)
+			if migration == nil {
+				return fmt.Errorf("%w: %d_%s", ErrMigrationNotFound, record.Version, record.Name)
+			}
+			if !migration.hasDown() {
+				return fmt.Errorf("%w: %d_%s", ErrMigrationNoDown, migration.Version, migration.Name)
+			}
+			if err := context.Cause(db.Statement.Context); err != nil {
+				return err
+			}
+			if err := m.apply(db, *migration, false); err != nil {
+				return err
+			}
+			done = append(done, *migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// DryRun 将Up或Down会执行的SQL写入w，不执行也不修改记录
+// Go函数迁移在gorm的DryRun会话中执行，依赖查询结果的迁移(如Migrator().HasTable)无法准确预览
+func (m *Migrator) DryRun(ctx context.Context, db *gorm.DB, w io.Writer, up bool, limit int64) error {
+	db = db.WithContext(WithPrimary(ctx))
+	if err := m.prepare(db); err != nil {
+		return err
+	}
+	applied, err := m.applied(db)
+	if err != nil {
+		return err
+	}
+	var plan []Migration
+	if up {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && (limit <= 0 || migration.Version <= limit) {
+				plan = append(plan, migration)
+			}
+		}
+	} else {
+		for i := len(m.migrations) - 1; i >= 0 && int64(len(plan)) < limit; i-- {
+			if _, ok := applied[m.migrations[i].Version]; ok {
+				plan = append(plan, m.migrations[i])
+			}
+		}
+	}
+	dry := db.Session(&gorm.Session{DryRun: true, Logger: &sqlWriter{w: w}})
+	for _, migration := range plan {
+		direction := "up"
+		if !up {
+			direction = "down"
+		}
+		_, _ = fmt.Fprintf(w, "-- %d_%s %s\n", migration.Version, migration.Name, direction)
+		if err := previewMigration(dry, migration, up); err != nil {
+			_, _ = fmt.Fprintf(w, "-- cannot preview: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func previewMigration(dry *gorm.DB, migration Migration, up bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return migration.run(dry, up)
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(db *gorm.DB, migration Migration, up bool) error {
+	start := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := migration.run(tx, up); err != nil {
+			return err
+		}
+		if up {
+			return m.history(tx).Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		}
+		return m.history(tx).Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("dbx: migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	direction := "applied"
+	if !up {
+		direction = "rolled back"
+	}
+	klog.Infof("migration %d_%s %s in %s", migration.Version, migration.Name, direction, time.Since(start))
+	return nil
+}
+
+// locked 持有迁移锁执行fn，持有期间定期续期
+// 续期失败或锁已被其他副本接管时取消传给fn的ctx，并返回ErrMigrationLockLost
+func (m *Migrator) locked(ctx context.Context, db *gorm.DB, fn func(db *gorm.DB) error) error {
+	db = db.WithContext(WithPrimary(ctx))
+	if err := m.prepare(db); err != nil {
+		return err
+	}
+	lockTable := m.opt.table + "_lock"
+	deadline := time.Now().Add(m.opt.lockTimeout)
+	for {
+		now := time.Now()
+		lock := &schemaMigrationLock{Id: 1, Owner: m.opt.owner, LockedUntil: now.Add(m.opt.lockTTL)}
+		res := db.Table(lockTable).Clauses(clause.OnConflict{DoNothing: true}).Create(lock)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// 接管已过期的锁
+			res = db.Table(lockTable).Where("id = ? AND locked_until < ?", 1, now).
+				Updates(map[string]any{"owner": lock.Owner, "locked_until": lock.LockedUntil})
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		if res.RowsAffected == 1 {
+			break
+		}
+		if now.After(deadline) {
+			return ErrMigrationLocked
+		}
+		klog.V(1).Info("waiting for migration lock")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	runCtx, lost := context.WithCancelCause(ctx)
+	defer lost(nil)
+	renewCtx, cancel := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(m.opt.lockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				res := db.Table(lockTable).Where("id = ? AND owner = ?", 1, m.opt.owner).
+					Update("locked_until", time.Now().Add(m.opt.lockTTL))
+				if res.Error != nil {
+					klog.Errorf("failed to renew migration lock, stopping migration: %v", res.Error)
+					lost(fmt.Errorf("%w: %v", ErrMigrationLockLost, res.Error))
+					return
+				}
+				if res.RowsAffected == 0 {
+					klog.Error("migration lock taken over by another instance, stopping migration")
+					lost(fmt.Errorf("%w: taken over by another instance", ErrMigrationLockLost))
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-renewed
+		err := db.Table(lockTable).Where("id = ? AND owner = ?", 1, m.opt.owner).Delete(&schemaMigrationLock{}).Error
+		if err != nil {
+			klog.Warningf("failed to release migration lock: %v", err)
+		}
+	}()
+	err := fn(db.WithContext(WithPrimary(runCtx)))
+	if cause := context.Cause(runCtx); errors.Is(cause, ErrMigrationLockLost) {
+		return cause
+	}
+	return err
+}
+
+// sqlWriter 将gorm生成的SQL写入w的日志，用于预览
+type sqlWriter struct {
+	w io.Writer
+}
+
+func (l *sqlWriter) LogMode(logger.LogLevel) logger.Interface {
+	return l
+}
+
+func (l *sqlWriter) Info(context.Context, string, ...any) {}
+
+func (l *sqlWriter) Warn(context.Context, string, ...any) {}
+
+func (l *sqlWriter) Error(context.Context, string, ...any) {}
+
+func (l *sqlWriter) Trace(_ context.Context, _ time.Time, fc func() (sql string, rowsAffected int64), _ error) {
+	sql, _ := fc()
+	_, _ = fmt.Fprintf(l.w, "%s;\n", sql)
+}
+
+// MigrateCommand 执行迁移子命令，输出写入out
+//
+//	up [-to 版本] [-dry-run]
+//	down [-steps 数量] [-dry-run]
+//	status
+func MigrateCommand(ctx context.Context, db *gorm.DB, m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: up [-to version] [-dry-run] | down [-steps n] [-dry-run] | status")
+	}
+	set := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	set.SetOutput(out)
+	dryRun := set.Bool("dry-run", false, "print SQL without executing")
+	switch args[0] {
+	case "up":
+		to := set.Int64("to", 0, "target version, 0 for latest")
+		if err := set.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *dryRun {
+			return m.DryRun(ctx, db, out, true, *to)
+		}
+		applied, err := m.Up(ctx, db, *to)
+		for _, migration := range applied {
+			_, _ = fmt.Fprintf(out, "applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			_, _ = fmt.Fprintln(out, "no pending migrations")
+		}
+		return err
+	case "down":
+		steps := set.Int("steps", 1, "number of migrations to roll back")
+		if err := set.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *dryRun {
+			return m.DryRun(ctx, db, out, false, int64(*steps))
+		}
+		rolledBack, err := m.Down(ctx, db, *steps)
+		for _, migration := range rolledBack {
+			_, _ = fmt.Fprintf(out, "rolled back %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		status, err := m.Status(ctx, db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Missing {
+				applied += " (missing)"
+			}
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %s", args[0])
+}
@@ -0,0 +1,206 @@
+package dbx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type migrateUser struct {
+	Id   int64
+	Name string
+}
+
+func testMigrator(t *testing.T) *Migrator {
+	m := NewMigrator(WithMigrationLockTimeout(time.Second * 10))
+	err := m.AddFS(fstest.MapFS{
+		"sql/0001_create_user.up.sql":   {Data: []byte("CREATE TABLE migrate_user (id INTEGER PRIMARY KEY, name TEXT)")},
+		"sql/0001_create_user.down.sql": {Data: []byte("DROP TABLE migrate_user")},
+		"sql/0003_add_email.up.sql":     {Data: []byte("ALTER TABLE migrate_user ADD COLUMN email TEXT")},
+		"sql/README.md":                 {Data: []byte("ignored")},
+	}, "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Add(Migration{
+		Version: 2,
+		Name:    "seed_user",
+		Up: func(tx *gorm.DB) error {
+			return tx.Create(&migrateUser{Id: 1, Name: "admin"}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Where("id = ?", 1).Delete(&migrateUser{}).Error
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add(Migration{Version: 2, Name: "again"}); err == nil {
+		t.Fatal("expect duplicate version")
+	}
+	return m
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	helper := &GormHelper{}
+	helper.SetMigrator(testMigrator(t))
+	cfg := &DBConfig{DBUrl: "sqlite:" + filepath.Join(t.TempDir(), "migrate.db"), DBInit: true}
+	if err := helper.Open(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Close()
+	m, db := helper.Migrator(), helper.DB()
+
+	var user migrateUser
+	if err := db.Raw("SELECT id, name FROM migrate_user WHERE email IS NULL").Scan(&user).Error; err != nil || user.Name != "admin" {
+		t.Fatalf("unexpected user %+v: %v", user, err)
+	}
+	if applied, err := m.Up(ctx, db, 0); err != nil || len(applied) != 0 {
+		t.Fatalf("expect no pending migrations, got %v: %v", applied, err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := MigrateCommand(ctx, db, m, []string{"down", "-steps", "2", "-dry-run"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-- 3_add_email down") || !strings.Contains(out.String(), "DELETE FROM `migrate_user`") {
+		t.Fatalf("unexpected dry run output:\n%s", out)
+	}
+	if _, err := m.Down(ctx, db, 1); !errors.Is(err, ErrMigrationNoDown) {
+		t.Fatalf("expect no down step, got %v", err)
+	}
+
+	// 3没有回滚步骤，手动撤销后继续回滚
+	if err := db.Exec("DELETE FROM schema_migration WHERE version = 3").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("ALTER TABLE migrate_user DROP COLUMN email").Error; err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := MigrateCommand(ctx, db, m, []string{"down", "-steps", "2"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "rolled back 2_seed_user\nrolled back 1_create_user\n" {
+		t.Fatalf("unexpected down output:\n%s", out)
+	}
+	if db.Migrator().HasTable("migrate_user") {
+		t.Fatal("expect migrate_user dropped")
+	}
+
+	out.Reset()
+	if err := MigrateCommand(ctx, db, m, []string{"up", "-to", "1"}, out); err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Status(ctx, db)
+	if err != nil || len(status) != 3 || status[0].AppliedAt == nil || status[1].AppliedAt != nil {
+		t.Fatalf("unexpected status %+v: %v", status, err)
+	}
+	out.Reset()
+	if err := MigrateCommand(ctx, db, m, []string{"status"}, out); err != nil || strings.Count(out.String(), "pending") != 2 {
+		t.Fatalf("unexpected status output:\n%s\n%v", out, err)
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	ctx := context.Background()
+	helper := &GormHelper{}
+	if err := helper.Open(&DBConfig{DBUrl: "sqlite:" + filepath.Join(t.TempDir(), "lock.db")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Close()
+	db := helper.DB()
+
+	var (
+		mu      sync.Mutex
+		running int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 3; i++ {
+		m := NewMigrator(WithMigrationLockTimeout(time.Second * 10))
+		_ = m.Add(Migration{Version: 1, Name: "slow", Up: func(tx *gorm.DB) error {
+			mu.Lock()
+			running++
+			mu.Unlock()
+			time.Sleep(time.Millisecond * 200)
+			return nil
+		}})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.Up(ctx, db, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if running != 1 {
+		t.Fatalf("expect migration to run once, got %d", running)
+	}
+
+	// 过期的锁可以被接管
+	expired := &schemaMigrationLock{Id: 1, Owner: "crashed", LockedUntil: time.Now().Add(-time.Second)}
+	if err := db.Table("schema_migration_lock").Create(expired).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := NewMigrator(WithMigrationLockTimeout(0))
+	if _, err := m.Status(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx, db, 0); err != nil {
+		t.Fatalf("expect expired lock to be taken over: %v", err)
+	}
+	held := &schemaMigrationLock{Id: 1, Owner: "other", LockedUntil: time.Now().Add(time.Minute)}
+	if err := db.Table("schema_migration_lock").Create(held).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(ctx, db, 0); !errors.Is(err, ErrMigrationLocked) {
+		t.Fatalf("expect locked, got %v", err)
+	}
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	ctx := context.Background()
+	helper := &GormHelper{}
+	if err := helper.Open(&DBConfig{DBUrl: "sqlite:" + filepath.Join(t.TempDir(), "lost.db")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Close()
+	db := helper.DB()
+
+	m := NewMigrator(WithMigrationLockTTL(time.Millisecond * 300))
+	err := m.Add(Migration{Version: 1, Name: "steal", Up: func(tx *gorm.DB) error {
+		// 模拟锁过期后被其他副本接管，等待下一次续期
+		if err := tx.Exec("UPDATE schema_migration_lock SET owner = 'other'").Error; err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond * 200)
+		return nil
+	}}, Migration{Version: 2, Name: "long", Up: func(tx *gorm.DB) error {
+		select {
+		case <-tx.Statement.Context.Done():
+			return tx.Statement.Context.Err()
+		case <-time.After(time.Second * 5):
+			return errors.New("migration was not stopped")
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := m.Up(ctx, db, 0)
+	if !errors.Is(err, ErrMigrationLockLost) || len(applied) != 1 {
+		t.Fatalf("expect lock lost after 1 migration, got %v: %v", applied, err)
+	}
+	var count int64
+	if err := db.Table("schema_migration").Count(&count).Error; err != nil || count != 1 {
+		t.Fatalf("expect only the first migration recorded, got %d: %v", count, err)
+	}
+}
@@ -0,0 +1,131 @@
+package dbx
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OutboxPending = iota
+	OutboxSent
+)
+
+// OutboxMessage 事务发件箱记录，与业务数据在同一事务中写入，由中继异步投递
+type OutboxMessage struct {
+	ID            uint64              `gorm:"primaryKey"`
+	MsgId         string              `gorm:"size:64;uniqueIndex;not null"`
+	Subject       string              `gorm:"size:255;not null"`
+	Header        map[string][]string `gorm:"serializer:json"`
+	Payload       []byte
+	Status        int       `gorm:"index:idx_outbox_pending,priority:1;not null;default:0"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_pending,priority:2"`
+	Attempts      int       `gorm:"not null;default:0"`
+	LastError     string    `gorm:"size:1024"`
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+// AutoMigrateOutbox 创建或更新发件箱表
+func AutoMigrateOutbox(db *gorm.DB) error {
+	return db.AutoMigrate(&OutboxMessage{})
+}
+
+// AddOutbox 在事务tx中写入一条待发送消息，MsgId用于JetStream去重
+func AddOutbox(tx *gorm.DB, subject string, payload []byte, header map[string][]string) (*OutboxMessage, error) {
+	msg := &OutboxMessage{
+		MsgId:         nuid.Next(),
+		Subject:       subject,
+		Header:        header,
+		Payload:       payload,
+		Status:        OutboxPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(msg).Error; err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// PendingOutbox 在事务tx中锁定并读取已到重试时间的待发送消息
+// 支持的数据库上使用SKIP LOCKED，多个中继实例不会取到相同的记录
+func PendingOutbox(tx *gorm.DB, limit int) ([]OutboxMessage, error) {
+	var msgs []OutboxMessage
+	query := tx.Where("status = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+		Order("id").Limit(limit)
+	if tx.Dialector.Name() != "sqlite" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+	}
+	if err := query.Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// ClaimOutbox 在短事务中领取待发送消息，并将其下次尝试时间推后lease
+// 领取后在事务外投递，lease内其他中继不会取到这些记录，中继崩溃时消息在lease后被重新领取
+func ClaimOutbox(db *gorm.DB, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	var msgs []OutboxMessage
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if msgs, err = PendingOutbox(tx, limit); err != nil || len(msgs) == 0 {
+			return err
+		}
+		ids := make([]uint64, len(msgs))
+		for i := range msgs {
+			ids[i] = msgs[i].ID
+		}
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).Update("next_attempt_at", time.Now().Add(lease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MarkOutboxSent 标记消息已投递
+func MarkOutboxSent(tx *gorm.DB, msg *OutboxMessage) error {
+	now := time.Now()
+	return tx.Model(msg).Updates(map[string]any{
+		"status":     OutboxSent,
+		"sent_at":    &now,
+		"attempts":   msg.Attempts + 1,
+		"last_error": "",
+	}).Error
+}
+
+// MarkOutboxFailed 记录投递失败并安排下次重试时间
+func MarkOutboxFailed(tx *gorm.DB, msg *OutboxMessage, cause error, retryAt time.Time) error {
+	lastError := truncateUTF8(cause.Error(), 1024)
+	return tx.Model(msg).Updates(map[string]any{
+		"attempts":        msg.Attempts + 1,
+		"last_error":      lastError,
+		"next_attempt_at": retryAt,
+	}).Error
+}
+
+// UpdateOutboxPayload 更新待发送消息的消息头与消息体，用于保存已转存到对象存储的引用
+func UpdateOutboxPayload(tx *gorm.DB, msg *OutboxMessage, header map[string][]string, payload []byte) error {
+	msg.Header, msg.Payload = header, payload
+	return tx.Model(msg).Select("header", "payload").Updates(msg).Error
+}
+
+// PurgeOutbox 删除投递时间早于before的已投递消息，返回删除的条数
+func PurgeOutbox(tx *gorm.DB, before time.Time) (int64, error) {
+	result := tx.Where("status = ? AND sent_at < ?", OutboxSent, before).Delete(&OutboxMessage{})
+	return result.RowsAffected, result.Error
+}
+
+// truncateUTF8 截断到不超过n字节，不切断多字节字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,103 @@
+package dbx
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestOutbox(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AutoMigrateOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	// 业务事务回滚时发件箱记录一并回滚
+	_ = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := AddOutbox(tx, "test.rollback", []byte("rollback"), nil); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback")
+	})
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := AddOutbox(tx, "test.commit", []byte("commit"), map[string][]string{"Content-Type": {"text/plain"}})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := PendingOutbox(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Subject != "test.commit" || msgs[0].Header["Content-Type"][0] != "text/plain" {
+		t.Fatalf("unexpected pending messages: %+v", msgs)
+	}
+	if err := MarkOutboxFailed(db, &msgs[0], errors.New("no responders"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ = PendingOutbox(db, 10); len(msgs) != 0 {
+		t.Fatalf("failed message should wait for retry: %+v", msgs)
+	}
+	var msg OutboxMessage
+	db.Take(&msg)
+	if err := MarkOutboxSent(db, &msg); err != nil {
+		t.Fatal(err)
+	}
+	db.Take(&msg)
+	if msg.Status != OutboxSent || msg.Attempts != 2 || msg.SentAt == nil {
+		t.Fatalf("unexpected sent message: %+v", msg)
+	}
+
+	// 领取后在租约内不会被再次领取
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := AddOutbox(tx, "test.claim", []byte("claim"), nil)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err = ClaimOutbox(db, 10, time.Hour); err != nil || len(msgs) != 1 || msgs[0].Subject != "test.claim" {
+		t.Fatalf("unexpected claimed messages: %+v, %v", msgs, err)
+	}
+	if msgs, _ = ClaimOutbox(db, 10, time.Hour); len(msgs) != 0 {
+		t.Fatalf("claimed message should be leased: %+v", msgs)
+	}
+
+	// 错误信息按字符截断
+	var claimed OutboxMessage
+	db.Where("subject = ?", "test.claim").Take(&claimed)
+	if err := MarkOutboxFailed(db, &claimed, errors.New(strings.Repeat("错", 400)), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateOutboxPayload(db, &claimed, map[string][]string{"Nats-Claim-Check": {"bucket/name"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var failed OutboxMessage
+	db.Take(&failed, claimed.ID)
+	if !utf8.ValidString(failed.LastError) || len(failed.LastError) != 1023 {
+		t.Fatalf("unexpected truncated error: %d bytes", len(failed.LastError))
+	}
+	if failed.Header["Nats-Claim-Check"][0] != "bucket/name" || len(failed.Payload) != 0 {
+		t.Fatalf("unexpected updated payload: %+v", failed)
+	}
+
+	// 只清理超过保留时间的已投递消息
+	if n, err := PurgeOutbox(db, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("unexpected purge result %d: %v", n, err)
+	}
+	if n, err := PurgeOutbox(db, time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("unexpected purge result %d: %v", n, err)
+	}
+	var count int64
+	db.Model(&OutboxMessage{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("pending message should be kept, got %d rows", count)
+	}
+}
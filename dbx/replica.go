@@ -0,0 +1,222 @@
+package dbx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	primaryNode = "primary"
+	// forcePrimaryKey 语句级强制主库的gorm设置
+	forcePrimaryKey = "dbx:primary"
+	nodeKey         = "dbx:node"
+)
+
+type primaryCtxKey struct{}
+
+// WithPrimary 标记ctx中的查询都使用主库，用于写入后立即读取
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryCtxKey{}, true)
+}
+
+// ReplicaStatus 从库的健康状态
+type ReplicaStatus struct {
+	Name    string
+	Healthy bool
+}
+
+type replica struct {
+	name    string
+	sqlDB   *sql.DB
+	healthy atomic.Bool
+}
+
+// replicaResolver 以gorm插件的方式将主库连接上的查询路由到健康的从库
+// 事务中的语句使用事务连接，不会被路由
+type replicaResolver struct {
+	primary  gorm.ConnPool
+	replicas []*replica
+	next     atomic.Uint32
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (r *replicaResolver) Name() string {
+	return "dbx:replica"
+}
+
+func (r *replicaResolver) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	// 只路由Query回调(Find、Take、Count、Pluck、Raw().Find等)
+	// Row、Rows与Raw().Scan使用主库，gorm的Migrator通过它们检查表结构，必须读取主库
+	if err := cb.Query().Before("gorm:query").Register("dbx:route_query", r.route); err != nil {
+		return err
+	}
+	// 在otelgorm结束span前标记执行节点，未启用otelgorm时追加在最后
+	for _, err := range []error{
+		cb.Create().Before("otel:after:create").Register("dbx:tag_create", r.tag),
+		cb.Query().Before("otel:after:select").Register("dbx:tag_query", r.tag),
+		cb.Delete().Before("otel:after:delete").Register("dbx:tag_delete", r.tag),
+		cb.Update().Before("otel:after:update").Register("dbx:tag_update", r.tag),
+		cb.Row().Before("otel:after:row").Register("dbx:tag_row", r.tag),
+		cb.Raw().Before("otel:after:raw").Register("dbx:tag_raw", r.tag),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replicaResolver) route(db *gorm.DB) {
+	stmt := db.Statement
+	if stmt.ConnPool != r.primary || r.forcePrimary(db) {
+		return
+	}
+	if _, ok := stmt.Clauses["FOR"]; ok {
+		// SELECT ... FOR UPDATE
+		return
+	}
+	if sql := strings.TrimSpace(stmt.SQL.String()); sql != "" && !strings.EqualFold(firstWord(sql), "select") {
+		// Raw构造的非查询语句
+		return
+	}
+	if rep := r.pick(); rep != nil {
+		stmt.ConnPool = rep.sqlDB
+		db.InstanceSet(nodeKey, rep.name)
+	}
+}
+
+func (r *replicaResolver) forcePrimary(db *gorm.DB) bool {
+	if v, ok := db.Get(forcePrimaryKey); ok && v == true {
+		return true
+	}
+	return db.Statement.Context != nil && db.Statement.Context.Value(primaryCtxKey{}) != nil
+}
+
+func firstWord(sql string) string {
+	if i := strings.IndexFunc(sql, func(r rune) bool { return r == ' ' || r == '\n' || r == '\t' || r == '(' }); i > 0 {
+		return sql[:i]
+	}
+	return sql
+}
+
+// pick 轮询选择健康的从库，全部不健康时返回nil以使用主库
+func (r *replicaResolver) pick() *replica {
+	n := uint32(len(r.replicas))
+	start := r.next.Add(1)
+	for i := uint32(0); i < n; i++ {
+		if rep := r.replicas[(start+i)%n]; rep.healthy.Load() {
+			return rep
+		}
+	}
+	return nil
+}
+
+func (r *replicaResolver) tag(db *gorm.DB) {
+	node := primaryNode
+	if v, ok := db.InstanceGet(nodeKey); ok {
+		node = v.(string)
+	}
+	trace.SpanFromContext(db.Statement.Context).SetAttributes(attribute.String("db.node", node))
+}
+
+// start 立即检查一次从库，之后每隔interval检查
+func (r *replicaResolver) start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	for _, rep := range r.replicas {
+		r.check(ctx, rep, interval)
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, rep := range r.replicas {
+					r.check(ctx, rep, interval)
+				}
+			}
+		}
+	}()
+}
+
+func (r *replicaResolver) check(ctx context.Context, rep *replica, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := rep.sqlDB.PingContext(ctx)
+	if ctx.Err() == context.Canceled {
+		return
+	}
+	healthy := err == nil
+	if rep.healthy.Swap(healthy) != healthy {
+		if healthy {
+			klog.Infof("db replica %s is healthy", rep.name)
+		} else {
+			klog.Warningf("db replica %s is unhealthy, reads fall back to other nodes: %v", rep.name, err)
+		}
+	}
+}
+
+func (r *replicaResolver) status() []ReplicaStatus {
+	status := make([]ReplicaStatus, len(r.replicas))
+	for i, rep := range r.replicas {
+		status[i] = ReplicaStatus{Name: rep.name, Healthy: rep.healthy.Load()}
+	}
+	return status
+}
+
+func (r *replicaResolver) close() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+	for _, rep := range r.replicas {
+		if err := rep.sqlDB.Close(); err != nil {
+			klog.Errorf("failed to close db replica %s: %v", rep.name, err)
+		}
+	}
+}
+
+// replicaConfig 生成从库的配置，entry为host、host:port或完整的数据库URL，其余参数与主库相同
+func (cfg *DBConfig) replicaConfig(entry string) (c *DBConfig, name string, err error) {
+	if strings.Contains(entry, "://") || strings.HasPrefix(entry, "sqlite:") || strings.HasPrefix(entry, "file:") {
+		u := *cfg
+		u.DBUrl = entry
+		if c, err = u.withURL(); err != nil {
+			return nil, "", err
+		}
+		if strings.HasPrefix(entry, "sqlite:") || strings.HasPrefix(entry, "file:") {
+			return c, c.DBName, nil
+		}
+		return c, net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort)), nil
+	}
+	r := *cfg
+	c = &r
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		c.DBHost = entry
+	} else {
+		c.DBHost = host
+		if c.DBPort, err = strconv.Atoi(port); err != nil {
+			return nil, "", fmt.Errorf("invalid replica port %s", port)
+		}
+	}
+	return c, net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort)), nil
+}
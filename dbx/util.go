@@ -2,24 +2,188 @@ package dbx
 
 import (
 	"fmt"
+	mysqlDriver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type DBProvider func(cfg *DBConfig) gorm.Dialector
 
 func MySQLProvider(cfg *DBConfig) gorm.Dialector {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		cfg.DBUser, cfg.DBPass, cfg.DBHost, cfg.DBPort, cfg.DBName)
-	return mysql.Open(dsn)
+	return mysql.Open(MySQLDSN(cfg))
+}
+
+// MySQLDSN 由配置生成MySQL连接串，DBTimeZone无效时使用本地时区
+func MySQLDSN(cfg *DBConfig) string {
+	c := mysqlDriver.NewConfig()
+	c.User, c.Passwd, c.DBName = cfg.DBUser, cfg.DBPass, cfg.DBName
+	c.Net, c.Addr = "tcp", net.JoinHostPort(cfg.DBHost, strconv.Itoa(cfg.DBPort))
+	c.ParseTime = true
+	c.Loc = time.Local
+	if cfg.DBTimeZone != "" {
+		if loc, err := time.LoadLocation(cfg.DBTimeZone); err == nil {
+			c.Loc = loc
+		}
+	}
+	switch cfg.DBSSLMode {
+	case "":
+	case "disable":
+		c.TLSConfig = "false"
+	case "require":
+		c.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		c.TLSConfig = "true"
+	default:
+		c.TLSConfig = cfg.DBSSLMode
+	}
+	c.Params = map[string]string{"charset": "utf8mb4"}
+	for k, v := range cfg.DBParams {
+		c.Params[k] = v
+	}
+	return c.FormatDSN()
 }
 
 func PostgresProvider(cfg *DBConfig) gorm.Dialector {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s",
-		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPass, cfg.DBName)
 	return postgres.New(postgres.Config{
-		DSN:                  dsn,
+		DSN:                  PostgresDSN(cfg),
 		PreferSimpleProtocol: true,
 	})
 }
+
+// PostgresDSN 由配置生成Postgres的key=value连接串
+func PostgresDSN(cfg *DBConfig) string {
+	params := []string{
+		"host=" + quotePostgres(cfg.DBHost),
+		"port=" + strconv.Itoa(cfg.DBPort),
+		"user=" + quotePostgres(cfg.DBUser),
+		"password=" + quotePostgres(cfg.DBPass),
+		"dbname=" + quotePostgres(cfg.DBName),
+	}
+	if cfg.DBSSLMode != "" {
+		params = append(params, "sslmode="+quotePostgres(cfg.DBSSLMode))
+	}
+	if cfg.DBTimeZone != "" {
+		params = append(params, "TimeZone="+quotePostgres(cfg.DBTimeZone))
+	}
+	for _, k := range sortedKeys(cfg.DBParams) {
+		params = append(params, k+"="+quotePostgres(cfg.DBParams[k]))
+	}
+	return strings.Join(params, " ")
+}
+
+func quotePostgres(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// SQLiteProvider 以DBName为数据库文件，:memory:为内存数据库，DBParams作为连接参数
+func SQLiteProvider(cfg *DBConfig) gorm.Dialector {
+	return sqlite.Open(SQLiteDSN(cfg))
+}
+
+// SQLiteDSN 由配置生成SQLite连接串
+func SQLiteDSN(cfg *DBConfig) string {
+	query := url.Values{}
+	for k, v := range cfg.DBParams {
+		query.Set(k, v)
+	}
+	if cfg.DBTimeZone != "" && !query.Has("_loc") {
+		query.Set("_loc", cfg.DBTimeZone)
+	}
+	if len(query) == 0 {
+		return cfg.DBName
+	}
+	sep := "?"
+	if strings.Contains(cfg.DBName, "?") {
+		sep = "&"
+	}
+	return cfg.DBName + sep + query.Encode()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ProviderForURL 按数据库URL的协议选择DBProvider，支持postgres、mysql与sqlite
+func ProviderForURL(rawURL string) (DBProvider, error) {
+	scheme, _, ok := strings.Cut(rawURL, ":")
+	if !ok {
+		return nil, fmt.Errorf("database url without scheme")
+	}
+	switch strings.ToLower(scheme) {
+	case "postgres", "postgresql":
+		return PostgresProvider, nil
+	case "mysql":
+		return MySQLProvider, nil
+	case "sqlite", "sqlite3", "file":
+		return SQLiteProvider, nil
+	}
+	return nil, fmt.Errorf("unsupported database scheme %s", scheme)
+}
+
+// withURL 返回以DBUrl覆盖连接参数后的配置副本，sslmode与其他查询参数分别并入DBSSLMode与DBParams
+func (cfg *DBConfig) withURL() (*DBConfig, error) {
+	u, err := url.Parse(cfg.DBUrl)
+	if err != nil {
+		return nil, err
+	}
+	c := *cfg
+	c.DBParams = make(map[string]string, len(cfg.DBParams))
+	for k, v := range cfg.DBParams {
+		c.DBParams[k] = v
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "sqlite" || scheme == "sqlite3" || scheme == "file" {
+		// sqlite:data.db、sqlite:///var/data.db、sqlite::memory:
+		c.DBName = u.Opaque
+		if c.DBName == "" {
+			c.DBName = u.Host + u.Path
+		}
+		if scheme == "file" {
+			c.DBName = "file:" + c.DBName
+		}
+	} else {
+		c.DBHost = u.Hostname()
+		switch {
+		case u.Port() != "":
+			if c.DBPort, err = strconv.Atoi(u.Port()); err != nil {
+				return nil, fmt.Errorf("invalid port %s", u.Port())
+			}
+		case scheme == "mysql":
+			c.DBPort = 3306
+		default:
+			c.DBPort = 5432
+		}
+		if u.User != nil {
+			c.DBUser = u.User.Username()
+			c.DBPass, _ = u.User.Password()
+		}
+		c.DBName = strings.TrimPrefix(u.Path, "/")
+	}
+	for k, v := range u.Query() {
+		switch k {
+		case "sslmode":
+			c.DBSSLMode = v[0]
+		case "TimeZone", "timezone":
+			c.DBTimeZone = v[0]
+		default:
+			c.DBParams[k] = v[0]
+		}
+	}
+	return &c, nil
+}
@@ -1,85 +1,108 @@
 package echox
 
 import (
-	"context"
+	"encoding/json"
 	"github.com/TiyaAnlite/FocotServicesCommon/envx"
-	"github.com/TiyaAnlite/FocotServicesCommon/utils"
 	"github.com/labstack/echo/v4"
-	"github.com/uptrace/uptrace-go/uptrace"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.opentelemetry.io/otel/trace"
-	"os"
-	"os/signal"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 )
 
 func TestOpel(t *testing.T) {
-	ctx := context.Background()
-	opelDSN := os.Getenv("TRACE_DSN")
-	if opelDSN == "" {
-		t.Error("openDSN not set")
-		t.FailNow()
-	}
-	uptrace.ConfigureOpentelemetry(
-		uptrace.WithDSN(opelDSN),
-		uptrace.WithServiceName("EchoHelper"),
-		uptrace.WithServiceVersion("test"),
-		uptrace.WithDeploymentEnvironment("test"),
-	)
-	defer uptrace.Shutdown(ctx)
+	recorder := tracetest.NewSpanRecorder()
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(provider)
+
 	traceFunc := func(c echo.Context) error {
 		var ch trace.Span
 		_, ch = RootTracer(c, "processing")
-		t.Logf("do something...")
-		time.Sleep(time.Second)
-		ch.End()
-		_, ch = RootTracer(c, "processing2")
-		time.Sleep(time.Millisecond * 500)
+		_, ch = RootTracerNext(ch, c, "processing2")
 		ch.End()
-		t.Logf("ok")
 		return NormalEmptyResponse(c)
 	}
-	go Run(&EchoConfig{
-		Port: 8080,
-	}, func(e *echo.Echo) {
-		e.Use(otelecho.Middleware("EchoHelperTest"))
-		e.Any("/", traceFunc)
-	})
-	utils.Wait4CtrlC()
+	e := echo.New()
+	e.Use(otelecho.Middleware("EchoHelperTest"))
+	e.Any("/", traceFunc)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expect 3 spans, got %d", len(spans))
+	}
+	root := spans[2]
+	if rec.Header().Get("X-Trace-Id") != root.SpanContext().TraceID().String() {
+		t.Fatalf("unexpected trace id header: %s", rec.Header().Get("X-Trace-Id"))
+	}
+	for i, name := range []string{"processing", "processing2"} {
+		span := spans[i]
+		if span.Name() != name || span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("unexpected span %s with parent %s", span.Name(), span.Parent().SpanID())
+		}
+		if attrs := span.Attributes(); len(attrs) != 1 || attrs[0].Value.AsString() != "req-1" {
+			t.Fatalf("unexpected attributes of %s: %v", name, attrs)
+		}
+	}
 }
 
 func TestEchoServer(t *testing.T) {
-	ctx := context.Background()
-	opelDSN := os.Getenv("TRACE_DSN")
-	if opelDSN == "" {
-		t.Error("openDSN not set")
-		t.FailNow()
-	}
-	uptrace.ConfigureOpentelemetry(
-		uptrace.WithDSN(opelDSN),
-		uptrace.WithServiceName("EchoHelper"),
-		uptrace.WithServiceVersion("test"),
-		uptrace.WithDeploymentEnvironment("test"),
-	)
-	defer uptrace.Shutdown(ctx)
 	cfg := &EchoConfig{
-		Port:              8080,
 		UseHealthCheck:    false,
 		TelemetryHostName: "EchoHelperTest",
 	}
 	envx.MustLoadEnv(cfg)
-	go Run(cfg, func(e *echo.Echo) {
-		e.Any("/", func(c echo.Context) error {
-			return NormalResponse(c, "ok")
-		})
-	})
-	ctrlc := make(chan os.Signal, 1)
-	signal.Notify(ctrlc, os.Interrupt)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Address, cfg.Port = "127.0.0.1", listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	done := make(chan struct{})
 	go func() {
-		time.Sleep(time.Second * 5)
-		ctrlc <- os.Interrupt
+		defer close(done)
+		Run(cfg, func(e *echo.Echo) {
+			e.Any("/", func(c echo.Context) error {
+				return NormalResponse(c, "ok")
+			})
+		})
 	}()
-	<-ctrlc
+	url := "http://" + net.JoinHostPort(cfg.Address, strconv.Itoa(cfg.Port)) + "/"
+	var resp *http.Response
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 20) {
+		if resp, err = http.Get(url); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	body := &ResponseWrapper{}
+	err = json.NewDecoder(resp.Body).Decode(body)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || body.Data != "ok" {
+		t.Fatalf("unexpected response: %d %+v %v", resp.StatusCode, body, err)
+	}
+
 	Shutdown(cfg)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("server not stopped after shutdown")
+	}
 }
@@ -0,0 +1,279 @@
+package echox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderJwtClaims 转发到NATS的JWT声明(JSON)
+	HeaderJwtClaims = "X-Jwt-Claims"
+	// HeaderUserId 使用默认JwtClaims时转发的用户ID
+	HeaderUserId = "X-User-Id"
+)
+
+// GatewayRoute HTTP路由到NATS主题的映射
+// Subject中的{name}会被替换为同名路径参数，如"orders.{id}.get"，占位符规则见parseGatewaySubject
+type GatewayRoute struct {
+	Method  string
+	Path    string
+	Subject string
+	// Timeout 为0时使用网关的默认超时
+	Timeout time.Duration
+}
+
+type gatewayOptions struct {
+	timeout      time.Duration
+	headers      []string
+	claimsKey    string
+	maxBodyBytes int64
+}
+
+type GatewayOption func(options *gatewayOptions)
+
+// WithGatewayTimeout 默认的请求超时，默认5秒
+func WithGatewayTimeout(timeout time.Duration) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.timeout = timeout
+	}
+}
+
+// WithGatewayHeaders 额外转发的请求头，X-Request-Id与Content-Type总会转发
+func WithGatewayHeaders(headers ...string) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.headers = append(options.headers, headers...)
+	}
+}
+
+// WithGatewayMaxBodyBytes 请求体的大小上限，超过时返回413，默认1MB(NATS默认的最大消息)，<=0时不限制
+func WithGatewayMaxBodyBytes(n int64) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.maxBodyBytes = n
+	}
+}
+
+// WithGatewayClaimsKey JWT中间件保存token的上下文键，默认与DefaultJwtConfig一致为"user"
+func WithGatewayClaimsKey(key string) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.claimsKey = key
+	}
+}
+
+// MountGateway 在路由组下挂载转发到NATS请求应答的路由
+// 应答转换为ResponseWrapper，应答中的服务错误头转换为对应的HTTP状态码，主题模板无效时panic
+func MountGateway(g *echo.Group, helper *natsx.NatsHelper, routes []GatewayRoute, option ...GatewayOption) {
+	opt := &gatewayOptions{timeout: time.Second * 5, claimsKey: "user", maxBodyBytes: 1 << 20}
+	for _, o := range option {
+		o(opt)
+	}
+	for _, route := range routes {
+		g.Add(route.Method, route.Path, gatewayHandler(helper, route, opt))
+	}
+}
+
+func gatewayHandler(helper *natsx.NatsHelper, route GatewayRoute, opt *gatewayOptions) echo.HandlerFunc {
+	timeout := route.Timeout
+	if timeout <= 0 {
+		timeout = opt.timeout
+	}
+	template := mustParseGatewaySubject(route.Subject)
+	return func(c echo.Context) error {
+		ctx, span := RootTracer(c, "nats gateway "+route.Subject)
+		defer span.End()
+		subject, err := resolveSubject(c, template, opt.claimsKey)
+		if err != nil {
+			return NormalErrorResponse(c, http.StatusBadRequest, http.StatusBadRequest, err.Error())
+		}
+		msg, err := gatewayMsg(c, subject, opt)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return NormalErrorResponse(c, http.StatusRequestEntityTooLarge, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+		}
+		if err != nil {
+			return NormalErrorResponse(c, http.StatusBadRequest, http.StatusBadRequest, err.Error())
+		}
+		// 客户端断开或超过截止时间时不再等待应答
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		reply, err := helper.RequestMsgCtx(ctx, msg)
+		if err != nil {
+			return gatewayError(c, subject, err)
+		}
+		return gatewayReply(c, reply)
+	}
+}
+
+// claimPlaceholder {claims.name}中的.不是主题分隔符，解析模板前替换为{claims:name}
+var claimPlaceholder = regexp.MustCompile(`\{claims\.([^{}.]+)\}`)
+
+// gatewaySubject 网关路由与推送订阅的主题模板，在natsx.SubjectTemplate的基础上允许*与>通配符token
+type gatewaySubject struct {
+	template  *natsx.SubjectTemplate
+	wildcards map[int]string
+}
+
+// parseGatewaySubject 解析主题模板，每个占位符需占据一个完整的token
+// {name}为路径参数，{user}为默认JwtClaims中的用户ID，{claims.name}为JWT中的声明
+func parseGatewaySubject(template string) (*gatewaySubject, error) {
+	tokens := strings.Split(claimPlaceholder.ReplaceAllString(template, "{claims:$1}"), ".")
+	subject := &gatewaySubject{wildcards: make(map[int]string)}
+	for i, token := range tokens {
+		if token == "*" || (token == ">" && i == len(tokens)-1) {
+			subject.wildcards[i] = token
+			tokens[i] = "_"
+		}
+	}
+	var err error
+	if subject.template, err = natsx.ParseSubject(strings.Join(tokens, ".")); err != nil {
+		return nil, fmt.Errorf("invalid subject template %s: %w", template, err)
+	}
+	return subject, nil
+}
+
+func mustParseGatewaySubject(template string) *gatewaySubject {
+	subject, err := parseGatewaySubject(template)
+	if err != nil {
+		panic(err)
+	}
+	return subject
+}
+
+// resolveSubject 以请求的路径参数与JWT声明生成主题，参数值不能包含主题分隔符、通配符或花括号
+func resolveSubject(c echo.Context, subject *gatewaySubject, claimsKey string) (string, error) {
+	params := subject.template.Params()
+	values := make(map[string]string, len(params))
+	if len(params) > 0 {
+		for _, name := range c.ParamNames() {
+			values[name] = c.Param(name)
+		}
+		if token, ok := c.Get(claimsKey).(*jwt.Token); ok && token.Valid {
+			if claims, ok := token.Claims.(*JwtClaims); ok {
+				values["user"] = strconv.Itoa(claims.UserId)
+			}
+			if slices.ContainsFunc(params, func(name string) bool { return strings.HasPrefix(name, "claims:") }) {
+				data, err := json.Marshal(token.Claims)
+				if err != nil {
+					return "", err
+				}
+				var claims map[string]any
+				decoder := json.NewDecoder(bytes.NewReader(data))
+				decoder.UseNumber()
+				if err := decoder.Decode(&claims); err != nil {
+					return "", err
+				}
+				for k, v := range claims {
+					if _, ok := v.(map[string]any); !ok {
+						values["claims:"+k] = fmt.Sprint(v)
+					}
+				}
+			}
+		}
+		for _, name := range params {
+			if strings.ContainsAny(values[name], "{}") {
+				return "", fmt.Errorf("invalid value for {%s}", strings.Replace(name, "claims:", "claims.", 1))
+			}
+		}
+	}
+	rendered, err := subject.template.Render(values)
+	if err != nil {
+		return "", err
+	}
+	if len(subject.wildcards) == 0 {
+		return rendered, nil
+	}
+	// 参数值不含.，渲染后token的位置不变
+	tokens := strings.Split(rendered, ".")
+	for i, wildcard := range subject.wildcards {
+		tokens[i] = wildcard
+	}
+	return strings.Join(tokens, "."), nil
+}
+
+func gatewayMsg(c echo.Context, subject string, opt *gatewayOptions) (*nats.Msg, error) {
+	req := c.Request()
+	msg := nats.NewMsg(subject)
+	if req.Body != nil {
+		body := req.Body
+		if opt.maxBodyBytes > 0 {
+			body = http.MaxBytesReader(c.Response(), req.Body, opt.maxBodyBytes)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = data
+	}
+	if contentType := req.Header.Get(echo.HeaderContentType); strings.HasPrefix(contentType, echo.MIMEApplicationJSON) {
+		msg.Header.Set(natsx.HeaderContentType, natsx.ContentTypeJson)
+	} else if contentType != "" {
+		msg.Header.Set(natsx.HeaderContentType, contentType)
+	}
+	for _, name := range append([]string{echo.HeaderXRequestID}, opt.headers...) {
+		if value := req.Header.Get(name); value != "" {
+			msg.Header.Set(name, value)
+		}
+	}
+	if token, ok := c.Get(opt.claimsKey).(*jwt.Token); ok && token.Valid {
+		claims, err := json.Marshal(token.Claims)
+		if err != nil {
+			return nil, err
+		}
+		msg.Header.Set(HeaderJwtClaims, string(claims))
+		if claims, ok := token.Claims.(*JwtClaims); ok {
+			msg.Header.Set(HeaderUserId, strconv.Itoa(claims.UserId))
+		}
+	}
+	return msg, nil
+}
+
+func gatewayError(c echo.Context, subject string, err error) error {
+	var schemaErr *natsx.SchemaError
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		return NormalErrorResponse(c, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "Service Unavailable")
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return NormalErrorResponse(c, http.StatusGatewayTimeout, http.StatusGatewayTimeout, "Gateway Timeout")
+	case errors.Is(err, context.Canceled):
+		// 客户端已断开，沿用nginx的499状态码
+		return NormalErrorResponse(c, 499, 499, "Client Closed Request")
+	case errors.As(err, &schemaErr):
+		return NormalErrorResponse(c, http.StatusBadRequest, http.StatusBadRequest, schemaErr.Error())
+	}
+	utils.ErrorWithCtx(c.Request().Context(), fmt.Sprintf("nats gateway request to %s failed: %v", subject, err))
+	return NormalErrorResponse(c, http.StatusBadGateway, http.StatusBadGateway, "Bad Gateway")
+}
+
+func gatewayReply(c echo.Context, reply *nats.Msg) error {
+	var serviceErr *natsx.ServiceErr
+	if errors.As(natsx.ServiceError(reply), &serviceErr) {
+		statusCode := serviceErr.Code
+		if statusCode < 400 || statusCode > 599 {
+			statusCode = http.StatusInternalServerError
+		}
+		return NormalErrorResponse(c, statusCode, serviceErr.Code, serviceErr.Description)
+	}
+	if len(reply.Data) == 0 {
+		return NormalEmptyResponse(c)
+	}
+	contentType := reply.Header.Get(natsx.HeaderContentType)
+	if (contentType == "" || contentType == natsx.ContentTypeJson) && json.Valid(reply.Data) {
+		return NormalResponse(c, json.RawMessage(reply.Data))
+	}
+	return NormalResponse(c, string(reply.Data))
+}
@@ -0,0 +1,126 @@
+package echox
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	service := connect()
+	err := service.AddNatsCtxHandler("orders.*.get", func(ctx context.Context, msg *nats.Msg) {
+		if msg.Subject == "orders.missing.get" {
+			_ = natsx.RespondError(msg, http.StatusNotFound, "order not found")
+			return
+		}
+		reply, _ := natsx.EncodeMsg(natsx.JsonCodec{}, msg.Reply, echo.Map{
+			"subject":   msg.Subject,
+			"requestId": msg.Header.Get(echo.HeaderXRequestID),
+			"body":      string(msg.Data),
+		})
+		_ = msg.RespondMsg(reply)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = service.Nc.Flush()
+
+	e := echo.New()
+	MountGateway(e.Group("/api"), connect(), []GatewayRoute{
+		{Method: http.MethodPost, Path: "/orders/:id", Subject: "orders.{id}.get"},
+		{Method: http.MethodGet, Path: "/nobody", Subject: "nobody.listening"},
+	}, WithGatewayTimeout(time.Second), WithGatewayMaxBodyBytes(64))
+
+	do := func(method, path, body string) (int, *ResponseWrapper) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXRequestID, "req-1")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		resp := &ResponseWrapper{}
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, resp
+	}
+
+	status, resp := do(http.MethodPost, "/api/orders/42", `{"n":1}`)
+	data, _ := resp.Data.(map[string]any)
+	if status != http.StatusOK || data["subject"] != "orders.42.get" || data["requestId"] != "req-1" || data["body"] != `{"n":1}` {
+		t.Fatalf("unexpected response: %d %+v", status, resp)
+	}
+	if status, resp = do(http.MethodPost, "/api/orders/missing", ""); status != http.StatusNotFound || resp.Message != "order not found" {
+		t.Fatalf("unexpected service error response: %d %+v", status, resp)
+	}
+	if status, resp = do(http.MethodPost, "/api/orders/42", strings.Repeat("x", 65)); status != http.StatusRequestEntityTooLarge || resp.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected response for large body: %d %+v", status, resp)
+	}
+	if status, _ = do(http.MethodPost, "/api/orders/a.b", ""); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status for invalid param: %d", status)
+	}
+	if status, _ = do(http.MethodGet, "/api/nobody", ""); status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status for no responders: %d", status)
+	}
+}
+
+func TestResolveSubject(t *testing.T) {
+	e := echo.New()
+	token := &jwt.Token{Valid: true, Claims: &JwtClaims{UserId: 7, RegisteredClaims: jwt.RegisteredClaims{Subject: "admin"}}}
+	for _, c := range []struct {
+		template string
+		params   map[string]string
+		want     string
+	}{
+		{template: "orders.list", want: "orders.list"},
+		{template: "orders.{id}.get", params: map[string]string{"id": "42"}, want: "orders.42.get"},
+		{template: "orders.{user}.>", want: "orders.7.>"},
+		{template: "orders.*.{claims.sub}", want: "orders.*.admin"},
+		// 参数值不能注入其他占位符或通配符
+		{template: "orders.{id}.{claims.sub}", params: map[string]string{"id": "{claims.sub}"}},
+		{template: "orders.{id}.get", params: map[string]string{"id": "}"}},
+		{template: "orders.{id}.get", params: map[string]string{"id": "a.b"}},
+		{template: "orders.{id}.get", params: map[string]string{"id": "*"}},
+		{template: "orders.{id}.get", params: map[string]string{"id": ">"}},
+		{template: "orders.{id}.get"},
+	} {
+		ctx := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		var names, values []string
+		for name, value := range c.params {
+			names, values = append(names, name), append(values, value)
+		}
+		ctx.SetParamNames(names...)
+		ctx.SetParamValues(values...)
+		ctx.Set("user", token)
+		subject, err := resolveSubject(ctx, mustParseGatewaySubject(c.template), "user")
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s %v: expect error, got %s", c.template, c.params, subject)
+			}
+			continue
+		}
+		if err != nil || subject != c.want {
+			t.Errorf("%s %v: expect %s, got %s %v", c.template, c.params, c.want, subject, err)
+		}
+	}
+	if _, err := parseGatewaySubject("orders.{id}x.get"); err == nil {
+		t.Error("expect error for partial placeholder")
+	}
+}
@@ -0,0 +1,307 @@
+package echox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StreamSubjectsFunc 确定连接要订阅的主题，返回错误时拒绝连接
+// 返回*echo.HTTPError时使用其状态码，其他错误视为403
+type StreamSubjectsFunc func(c echo.Context) ([]string, error)
+
+// StreamMessage WebSocket推送的消息格式，消息体是JSON时原样嵌入，否则为字符串
+type StreamMessage struct {
+	Subject string `json:"subject"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type streamOptions struct {
+	heartbeat   time.Duration
+	buffer      int
+	dropOnFull  bool
+	claimsKey   string
+	authorize   func(c echo.Context, subject string) error
+	checkOrigin func(r *http.Request) bool
+}
+
+type StreamOption func(options *streamOptions)
+
+// WithStreamHeartbeat 心跳间隔，默认15秒
+func WithStreamHeartbeat(interval time.Duration) StreamOption {
+	return func(options *streamOptions) {
+		options.heartbeat = interval
+	}
+}
+
+// WithStreamBuffer 每个连接的待发送消息数上限，默认64
+// 超出时默认断开连接让客户端重连，dropOnFull为true时丢弃新消息
+func WithStreamBuffer(size int, dropOnFull bool) StreamOption {
+	return func(options *streamOptions) {
+		options.buffer = size
+		options.dropOnFull = dropOnFull
+	}
+}
+
+// WithStreamAuthorizer 逐个检查连接是否可以订阅主题
+func WithStreamAuthorizer(authorize func(c echo.Context, subject string) error) StreamOption {
+	return func(options *streamOptions) {
+		options.authorize = authorize
+	}
+}
+
+// WithStreamClaimsKey JWT中间件保存token的上下文键，默认为"user"
+func WithStreamClaimsKey(key string) StreamOption {
+	return func(options *streamOptions) {
+		options.claimsKey = key
+	}
+}
+
+// WithStreamCheckOrigin WebSocket的来源检查，默认只允许同源
+func WithStreamCheckOrigin(checkOrigin func(r *http.Request) bool) StreamOption {
+	return func(options *streamOptions) {
+		options.checkOrigin = checkOrigin
+	}
+}
+
+// StreamSubjects 按模板确定订阅主题，占位符规则与网关路由相同
+// 如"orders.{user}.>"只会订阅当前用户的主题
+// 模板无效时panic
+func StreamSubjects(templates ...string) StreamSubjectsFunc {
+	subjects := make([]*gatewaySubject, len(templates))
+	for i, template := range templates {
+		subjects[i] = mustParseGatewaySubject(template)
+	}
+	return func(c echo.Context) ([]string, error) {
+		claimsKey, _ := c.Get(streamClaimsKey).(string)
+		if claimsKey == "" {
+			claimsKey = "user"
+		}
+		resolved := make([]string, 0, len(subjects))
+		for _, template := range subjects {
+			subject, err := resolveSubject(c, template, claimsKey)
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			resolved = append(resolved, subject)
+		}
+		return resolved, nil
+	}
+}
+
+// streamClaimsKey 在上下文中保存claimsKey，供StreamSubjects使用
+const streamClaimsKey = "echox.stream.claims_key"
+
+func newStreamOptions(option []StreamOption) *streamOptions {
+	opt := &streamOptions{heartbeat: time.Second * 15, buffer: 64, claimsKey: "user"}
+	for _, o := range option {
+		o(opt)
+	}
+	return opt
+}
+
+// streamClient 一个推送连接的订阅与待发送队列
+type streamClient struct {
+	msgs    chan *nats.Msg
+	subs    []*nats.Subscription
+	slow    chan struct{}
+	slowed  atomic.Bool
+	dropped atomic.Int64
+}
+
+// subscribeStream 检查权限并订阅主题，失败时已写入错误应答
+func subscribeStream(c echo.Context, helper *natsx.NatsHelper, subjects StreamSubjectsFunc, opt *streamOptions) (*streamClient, error) {
+	c.Set(streamClaimsKey, opt.claimsKey)
+	list, err := subjects(c)
+	if err == nil && len(list) == 0 {
+		err = echo.NewHTTPError(http.StatusBadRequest, "no subjects to subscribe")
+	}
+	for i := 0; err == nil && opt.authorize != nil && i < len(list); i++ {
+		err = opt.authorize(c, list[i])
+	}
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) {
+			httpErr = echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return nil, NormalErrorResponse(c, httpErr.Code, httpErr.Code, fmt.Sprint(httpErr.Message))
+	}
+
+	client := &streamClient{msgs: make(chan *nats.Msg, opt.buffer), slow: make(chan struct{})}
+	for _, subject := range list {
+		sub, err := helper.Subscribe(subject, func(_ context.Context, msg *nats.Msg) {
+			client.push(msg, opt.dropOnFull)
+		})
+		if err != nil {
+			client.close()
+			return nil, NormalErrorResponse(c, http.StatusBadGateway, http.StatusBadGateway, "failed to subscribe")
+		}
+		client.subs = append(client.subs, sub)
+	}
+	return client, nil
+}
+
+func (client *streamClient) push(msg *nats.Msg, dropOnFull bool) {
+	select {
+	case client.msgs <- msg:
+		return
+	default:
+	}
+	if dropOnFull {
+		client.dropped.Add(1)
+		return
+	}
+	if client.slowed.CompareAndSwap(false, true) {
+		close(client.slow)
+	}
+}
+
+func (client *streamClient) close() {
+	for _, sub := range client.subs {
+		_ = sub.Unsubscribe()
+	}
+	if dropped := client.dropped.Load(); dropped > 0 {
+		klog.Warningf("stream client dropped %d messages", dropped)
+	}
+}
+
+// SSE 以Server-Sent Events推送订阅的消息，事件名为消息主题
+func SSE(helper *natsx.NatsHelper, subjects StreamSubjectsFunc, option ...StreamOption) echo.HandlerFunc {
+	opt := newStreamOptions(option)
+	return func(c echo.Context) error {
+		client, err := subscribeStream(c, helper, subjects, opt)
+		if client == nil {
+			return err
+		}
+		defer client.close()
+
+		header := c.Response().Header()
+		header.Set(echo.HeaderContentType, "text/event-stream")
+		header.Set(echo.HeaderCacheControl, "no-cache")
+		header.Set(echo.HeaderConnection, "keep-alive")
+		header.Set("X-Accel-Buffering", "no") // 关闭nginx的缓冲
+		c.Response().WriteHeader(http.StatusOK)
+		c.Response().Flush()
+
+		ticker := time.NewTicker(opt.heartbeat)
+		defer ticker.Stop()
+		done := c.Request().Context().Done()
+		for {
+			select {
+			case <-done:
+				return nil
+			case <-client.slow:
+				_, _ = fmt.Fprint(c.Response(), "event: error\ndata: slow consumer\n\n")
+				c.Response().Flush()
+				return nil
+			case <-ticker.C:
+				if _, err := fmt.Fprint(c.Response(), ": ping\n\n"); err != nil {
+					return nil
+				}
+			case msg := <-client.msgs:
+				if err := writeSSE(c.Response(), msg); err != nil {
+					return nil
+				}
+			}
+			c.Response().Flush()
+		}
+	}
+}
+
+func writeSSE(w *echo.Response, msg *nats.Msg) error {
+	var b strings.Builder
+	b.WriteString("event: ")
+	b.WriteString(msg.Subject)
+	b.WriteByte('\n')
+	for _, line := range strings.Split(string(msg.Data), "\n") {
+		b.WriteString("data: ")
+		b.WriteString(strings.TrimSuffix(line, "\r"))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
+
+// WebSocket 升级为WebSocket并以StreamMessage格式推送订阅的消息
+// 客户端发送的消息会被忽略，读取只用于检测断开与心跳应答
+func WebSocket(helper *natsx.NatsHelper, subjects StreamSubjectsFunc, option ...StreamOption) echo.HandlerFunc {
+	opt := newStreamOptions(option)
+	upgrader := websocket.Upgrader{CheckOrigin: opt.checkOrigin}
+	return func(c echo.Context) error {
+		client, err := subscribeStream(c, helper, subjects, opt)
+		if client == nil {
+			return err
+		}
+		defer client.close()
+		conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// Upgrade已返回错误应答
+			return nil
+		}
+		defer conn.Close()
+
+		// 超过两个心跳周期没有收到任何数据(包括pong)时视为断开
+		readTimeout := opt.heartbeat * 2
+		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(readTimeout))
+		})
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+			}
+		}()
+
+		ticker := time.NewTicker(opt.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return nil
+			case <-client.slow:
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"), time.Now().Add(time.Second))
+				return nil
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(opt.heartbeat)); err != nil {
+					return nil
+				}
+			case msg := <-client.msgs:
+				_ = conn.SetWriteDeadline(time.Now().Add(opt.heartbeat))
+				if err := conn.WriteJSON(streamMessage(msg)); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func streamMessage(msg *nats.Msg) *StreamMessage {
+	m := &StreamMessage{Subject: msg.Subject}
+	if len(msg.Data) == 0 {
+		return m
+	}
+	contentType := msg.Header.Get(natsx.HeaderContentType)
+	if (contentType == "" || contentType == natsx.ContentTypeJson) && json.Valid(msg.Data) {
+		m.Data = json.RawMessage(msg.Data)
+	} else {
+		m.Data = string(msg.Data)
+	}
+	return m
+}
@@ -0,0 +1,103 @@
+package echox
+
+import (
+	"bufio"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	helper, publisher := connect(), connect()
+
+	e := echo.New()
+	authorize := WithStreamAuthorizer(func(c echo.Context, subject string) error {
+		if strings.HasPrefix(subject, "events.private") {
+			return errors.New("forbidden")
+		}
+		return nil
+	})
+	e.GET("/sse/:topic", SSE(helper, StreamSubjects("events.{topic}"), authorize))
+	e.GET("/ws/:topic", WebSocket(helper, StreamSubjects("events.{topic}"), authorize))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// 等待订阅生效后再发布
+	publishUntil := func(subject string, received <-chan string) string {
+		deadline := time.After(time.Second * 5)
+		for {
+			if err := publisher.PublishJson(subject, echo.Map{"n": 1}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case line := <-received:
+				return line
+			case <-time.After(time.Millisecond * 50):
+			case <-deadline:
+				t.Fatal("no message received")
+			}
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/sse/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status for unauthorized subject: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/sse/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+	if line := publishUntil("events.public", lines); line != `data: {"n":1}` {
+		t.Fatalf("unexpected sse data: %s", line)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/public", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := make(chan string, 16)
+	go func() {
+		for {
+			var msg StreamMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			messages <- msg.Subject
+		}
+	}()
+	if subject := publishUntil("events.public", messages); subject != "events.public" {
+		t.Fatalf("unexpected websocket message subject: %s", subject)
+	}
+}
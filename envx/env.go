@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
 	"github.com/caarlos0/env/v6"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/nats-io/nats.go"
@@ -24,6 +25,14 @@ func MustLoadEnv(v any, opts ...env.Options) {
 	}
 }
 
+// envAutoLoadParams 配置自动重载主题的参数
+type envAutoLoadParams struct {
+	Project string `subject:"project"`
+}
+
+// envAutoLoadSubject 重新加载项目的全部配置，其后追加配置名时只重新加载该配置，配置名可以包含多个token
+var envAutoLoadSubject = natsx.MustSubject[envAutoLoadParams]("envAutoLoad.{project}")
+
 type rdbEnvLoaderOptions struct {
 	envOptions          env.Options
 	autoLoadProjectName string
@@ -85,15 +94,20 @@ func LoadEnvFromRedis(v any, r *redis.Client, key string, option ...RdbEnvLoader
 	}
 	// auto load
 	if opt.autoLoadProjectName != "" && opt.notifyMq != nil && opt.pendingLock != nil {
-		subjectPrefix := fmt.Sprintf("%s.%s", "envAutoLoad", opt.autoLoadProjectName)
-		handler := envAutoReloadHandler(v, key, r, subjectPrefix, opt)
-		if _, err := opt.notifyMq.Subscribe(subjectPrefix, handler); err != nil {
-			return fmt.Errorf("failed to subscribe to envAutoLoad subject [%s]: %s", opt.autoLoadProjectName, err.Error())
+		project := envAutoLoadParams{Project: opt.autoLoadProjectName}
+		subject, err := envAutoLoadSubject.Render(project)
+		if err != nil {
+			return fmt.Errorf("invalid envAutoLoad project name [%s]: %s", opt.autoLoadProjectName, err.Error())
+		}
+		fieldSubject := subject + ".>"
+		handler := envAutoReloadHandler(v, key, r, subject, opt)
+		if _, err := opt.notifyMq.Subscribe(subject, handler); err != nil {
+			return fmt.Errorf("failed to subscribe to envAutoLoad subject [%s]: %s", subject, err.Error())
 		}
-		if _, err := opt.notifyMq.Subscribe(subjectPrefix+".>", handler); err != nil {
-			return fmt.Errorf("failed to subscribe to envAutoLoad subject [%s]: %s", opt.autoLoadProjectName+".>", err.Error())
+		if _, err := opt.notifyMq.Subscribe(fieldSubject, handler); err != nil {
+			return fmt.Errorf("failed to subscribe to envAutoLoad subject [%s]: %s", fieldSubject, err.Error())
 		}
-		klog.Infof("LoadEnvFromRedis: setup autoload at: %s", subjectPrefix)
+		klog.Infof("LoadEnvFromRedis: setup autoload at: %s", subject)
 	}
 	return nil
 }
@@ -104,14 +118,13 @@ func MustLoadEnvFromRedis(v any, r *redis.Client, key string, option ...RdbEnvLo
 	}
 }
 
-func envAutoReloadHandler(v any, key string, r *redis.Client, subjectPrefix string, opt *rdbEnvLoaderOptions) func(msg *nats.Msg) {
+func envAutoReloadHandler(v any, key string, r *redis.Client, prefix string, opt *rdbEnvLoaderOptions) func(msg *nats.Msg) {
 	return func(msg *nats.Msg) {
 		opt.pendingLock.Lock()
 		defer opt.pendingLock.Unlock()
 		ctx, cancel := context.WithTimeout(context.Background(), opt.loadTimeout)
 		defer cancel()
-		subject := strings.TrimPrefix(msg.Subject, subjectPrefix)
-		if subject == "" {
+		if msg.Subject == prefix {
 			// load all
 			klog.Info("[AutoRedisEnv]Auto reloading all config")
 			val, err := r.HGetAll(ctx, key).Result()
@@ -135,7 +148,7 @@ func envAutoReloadHandler(v any, key string, r *redis.Client, subjectPrefix stri
 			_ = msg.Respond([]byte("ok"))
 			return
 		}
-		subject = strings.TrimPrefix(subject, ".")
+		subject := strings.TrimPrefix(msg.Subject, prefix+".")
 		// load single
 		klog.Infof("[AutoRedisEnv]Auto reloading config: %s", subject)
 		val, err := r.HGet(ctx, key, subject).Result()
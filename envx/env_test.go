@@ -1,9 +1,12 @@
 package envx
 
 import (
-	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"context"
 	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/redis/go-redis/v9"
 	"k8s.io/klog/v2"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -16,48 +19,145 @@ type testEnv struct {
 	D string `env:"a.b.c"`
 }
 
+// fakeRedis 在客户端钩子中应答HGETALL与HGET，不连接Redis
+type fakeRedis struct {
+	lock   sync.Mutex
+	hashes map[string]map[string]string
+}
+
+func (f *fakeRedis) set(key, field, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.hashes[key] == nil {
+		f.hashes[key] = make(map[string]string)
+	}
+	f.hashes[key][field] = value
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, redis.ErrClosed
+	}
+}
+
+func (f *fakeRedis) ProcessHook(_ redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		args := cmd.Args()
+		hash := f.hashes[args[1].(string)]
+		switch c := cmd.(type) {
+		case *redis.MapStringStringCmd:
+			val := make(map[string]string, len(hash))
+			for k, v := range hash {
+				val[k] = v
+			}
+			c.SetVal(val)
+		case *redis.StringCmd:
+			v, ok := hash[args[2].(string)]
+			if !ok {
+				c.SetErr(redis.Nil)
+				return redis.Nil
+			}
+			c.SetVal(v)
+		}
+		return nil
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func newFakeRedis() (*fakeRedis, *redis.Client) {
+	fake := &fakeRedis{hashes: make(map[string]map[string]string)}
+	client := redis.NewClient(&redis.Options{Addr: "fake:6379"})
+	client.AddHook(fake)
+	return fake, client
+}
+
 func TestEnv(t *testing.T) {
+	t.Setenv("b", "b-env")
 	c := testEnv{}
 	MustLoadEnv(&c)
 	klog.Infof("a: %s, b: %s, c: %s", c.A, c.B, c.C)
+	if c.B != "b-env" || c.C != "c-default-string" {
+		t.Fatalf("unexpected env: %+v", c)
+	}
 }
 
 func TestRedisEnv(t *testing.T) {
+	fake, client := newFakeRedis()
+	defer client.Close()
+	fake.set("config", "a", "a-redis")
+	fake.set("config", "b", "b-redis")
 	c := testEnv{}
-	cfg := &dbx.RedisConfig{}
-	MustLoadEnv(cfg)
-	helper := dbx.RedisHelper{}
-	err := helper.Open(cfg)
-	if err != nil {
-		t.Fatal(err)
-	}
-	db := helper.DB()
-	MustLoadEnvFromRedis(&c, db, "config")
+	MustLoadEnvFromRedis(&c, client, "config")
 	klog.Infof("a: %s, b: %s, c: %s", c.A, c.B, c.C)
+	if c.A != "a-redis" || c.B != "b-redis" || c.C != "c-default-string" {
+		t.Fatalf("unexpected env: %+v", c)
+	}
+	if err := LoadEnvFromRedis(&testEnv{}, client, "missing"); err == nil {
+		t.Fatal("expect error for missing required field")
+	}
 }
 
 func TestRedisAutoEnv(t *testing.T) {
+	fake, client := newFakeRedis()
+	defer client.Close()
+	fake.set("config", "a", "a-redis")
+	fake.set("config", "b", "b-redis")
+
+	// 连接不接收自己发送的消息，通知使用另一个连接发送
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	helper, notifier := connect(), connect()
 	c := testEnv{}
-	cfg := &dbx.RedisConfig{}
-	MustLoadEnv(cfg)
-	helper := dbx.RedisHelper{}
-	err := helper.Open(cfg)
-	if err != nil {
-		t.Fatal(err)
-	}
-	nats := natsx.NatsHelper{}
-	natsCfg := &natsx.NatsConfig{}
-	MustLoadEnv(natsCfg)
-	if err := nats.Open(*natsCfg); err != nil {
-		t.Fatal(err)
-	}
-	db := helper.DB()
 	lock := &sync.RWMutex{}
-	MustLoadEnvFromRedis(&c, db, "config", WithRdbEnvAutoLoad("testProj", nats.Nc, lock))
-	for range time.Tick(time.Second) {
+	MustLoadEnvFromRedis(&c, client, "config", WithRdbEnvAutoLoad("testProj", helper.Nc, lock))
+	_ = helper.Nc.Flush()
+	notify := func(subject string) string {
+		reply, err := notifier.Nc.Request(subject, nil, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(reply.Data)
+	}
+	current := func() testEnv {
 		lock.RLock()
-		klog.Infof("a: %s, b: %s, c: %s, d: %s", c.A, c.B, c.C, c.D)
-		time.Sleep(time.Millisecond * 500) // do something
-		lock.RUnlock()
+		defer lock.RUnlock()
+		return c
+	}
+
+	// 重新加载单个配置，配置名可以包含多个token
+	fake.set("config", "b", "b-reload")
+	fake.set("config", "a.b.c", "d-reload")
+	if reply := notify("envAutoLoad.testProj.b"); reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if reply := notify("envAutoLoad.testProj.a.b.c"); reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if env := current(); env.A != "a-redis" || env.B != "b-reload" || env.D != "d-reload" {
+		t.Fatalf("unexpected env after field reload: %+v", env)
+	}
+	if reply := notify("envAutoLoad.testProj.missing"); reply != "LoadEnvFromRedis: key[config]->field[missing] not found" {
+		t.Fatalf("unexpected reply for missing field: %s", reply)
+	}
+
+	// 重新加载全部配置
+	fake.set("config", "a", "a-reload")
+	if reply := notify("envAutoLoad.testProj"); reply != "ok" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	if env := current(); env.A != "a-reload" || env.B != "b-reload" {
+		t.Fatalf("unexpected env after full reload: %+v", env)
 	}
 }
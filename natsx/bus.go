@@ -0,0 +1,69 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"sync"
+)
+
+// Publisher 发布消息，业务代码依赖该接口而不是*NatsHelper时可以在测试中使用MemoryBus
+type Publisher interface {
+	PublishCtx(ctx context.Context, subject string, data []byte) error
+	PublishMsgCtx(ctx context.Context, msg *nats.Msg) error
+	PublishEncodedCtx(ctx context.Context, subject string, v any, codec ...Codec) error
+}
+
+// Requester 请求应答
+type Requester interface {
+	RequestCtx(ctx context.Context, subject string, data []byte) (*nats.Msg, error)
+	RequestMsgCtx(ctx context.Context, msg *nats.Msg) (*nats.Msg, error)
+	RequestJsonCtx(ctx context.Context, subject string, v any, vPtr any) error
+	RequestEncodedCtx(ctx context.Context, subject string, v any, vPtr any, codec ...Codec) error
+}
+
+// Subscriber 注册消息处理器，处理器在Close时取消
+// 处理器应通过Respond、RespondMsg或RespondError应答，msg.Respond只在真实连接上可用
+type Subscriber interface {
+	AddNatsHandler(subject string, handler nats.MsgHandler) error
+	AddNatsCtxHandler(subject string, handler MsgHandler) error
+	AddNatsQueueHandler(subject string, queue string, handler MsgHandler) error
+	AddNatsJSONHandler(subject string, handler nats.Handler) error
+	AddNatsEncodedHandler(subject string, handler nats.Handler, codec ...Codec) error
+}
+
+// Bus 消息总线，由NatsHelper与MemoryBus实现
+type Bus interface {
+	Publisher
+	Requester
+	Subscriber
+	Use(middleware ...Middleware)
+	Close()
+}
+
+var (
+	_ Bus = (*NatsHelper)(nil)
+	_ Bus = (*MemoryBus)(nil)
+)
+
+// memoryReplies MemoryBus投递的消息的应答主题到总线的映射，供Respond在没有连接时使用
+// 每个应答主题只接受一次应答，之后的应答与真实连接上未绑定订阅的消息一样返回错误
+var memoryReplies sync.Map
+
+// Respond 应答请求，同时支持真实连接与MemoryBus投递的消息
+func Respond(msg *nats.Msg, data []byte) error {
+	reply := nats.NewMsg(msg.Reply)
+	reply.Data = data
+	return RespondMsg(msg, reply)
+}
+
+// RespondMsg 以带消息头的消息应答请求，同时支持真实连接与MemoryBus投递的消息
+func RespondMsg(msg *nats.Msg, reply *nats.Msg) error {
+	if msg.Sub == nil && msg.Reply != "" {
+		if bus, ok := memoryReplies.Load(msg.Reply); ok {
+			reply.Subject = msg.Reply
+			bus.(*MemoryBus).forgetReply(msg.Reply)
+			return bus.(*MemoryBus).PublishMsgCtx(context.Background(), reply)
+		}
+	}
+	return msg.RespondMsg(reply)
+}
@@ -0,0 +1,190 @@
+package natsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// HeaderContentType 消息头中记录编码类型的字段
+const HeaderContentType = "Content-Type"
+
+const (
+	ContentTypeJson     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+var (
+	ErrCodecNotFound   = errors.New("natsx: codec not found")
+	ErrInvalidProtobuf = errors.New("natsx: value is not a proto.Message")
+	ErrInvalidRaw      = errors.New("natsx: raw codec only supports []byte, *[]byte, string, *string")
+)
+
+// Codec 消息编解码器
+type Codec interface {
+	ContentType() string
+	Encode(subject string, v any) ([]byte, error)
+	Decode(subject string, data []byte, vPtr any) error
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[string]Codec{}
+)
+
+// RegisterCodec 注册编解码器，以便接收方按消息头中的Content-Type解码
+func RegisterCodec(codec Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecByContentType 按Content-Type查找已注册的编解码器
+func CodecByContentType(contentType string) (Codec, error) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	if codec, ok := codecs[contentType]; ok {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrCodecNotFound, contentType)
+}
+
+func init() {
+	RegisterCodec(JsonCodec{})
+	RegisterCodec(ProtobufCodec{})
+	RegisterCodec(MsgpackCodec{})
+	RegisterCodec(RawCodec{})
+}
+
+// JsonCodec 默认的JSON编解码器
+type JsonCodec struct{}
+
+func (JsonCodec) ContentType() string {
+	return ContentTypeJson
+}
+
+func (JsonCodec) Encode(_ string, v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonCodec) Decode(_ string, data []byte, vPtr any) error {
+	return json.Unmarshal(data, vPtr)
+}
+
+// ProtobufCodec 要求值实现proto.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Encode(_ string, v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrInvalidProtobuf
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Decode(_ string, data []byte, vPtr any) error {
+	m, ok := vPtr.(proto.Message)
+	if !ok {
+		return ErrInvalidProtobuf
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MsgpackCodec MessagePack编解码器，字段名沿用json标签
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (MsgpackCodec) Encode(_ string, v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgpackCodec) Decode(_ string, data []byte, vPtr any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(vPtr)
+}
+
+// RawCodec 不做转换，直接收发字节
+type RawCodec struct{}
+
+func (RawCodec) ContentType() string {
+	return ContentTypeRaw
+}
+
+func (RawCodec) Encode(_ string, v any) ([]byte, error) {
+	switch arg := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return arg, nil
+	case *[]byte:
+		return *arg, nil
+	case string:
+		return []byte(arg), nil
+	case *string:
+		return []byte(*arg), nil
+	}
+	return nil, ErrInvalidRaw
+}
+
+func (RawCodec) Decode(_ string, data []byte, vPtr any) error {
+	switch arg := vPtr.(type) {
+	case *[]byte:
+		*arg = append((*arg)[:0], data...)
+	case *string:
+		*arg = string(data)
+	default:
+		return ErrInvalidRaw
+	}
+	return nil
+}
+
+// EncodeMsg 使用编解码器构造带Content-Type头的消息
+func EncodeMsg(codec Codec, subject string, v any) (*nats.Msg, error) {
+	data, err := codec.Encode(subject, v)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(HeaderContentType, codec.ContentType())
+	return msg, nil
+}
+
+// DecodeMsg 按消息头中的Content-Type解码，未携带时使用fallback
+func DecodeMsg(msg *nats.Msg, vPtr any, fallback Codec) error {
+	codec := fallback
+	if contentType := msg.Header.Get(HeaderContentType); contentType != "" {
+		var err error
+		if codec, err = CodecByContentType(contentType); err != nil {
+			return err
+		}
+	}
+	if codec == nil {
+		codec = JsonCodec{}
+	}
+	return codec.Decode(msg.Subject, msg.Data, vPtr)
+}
@@ -0,0 +1,80 @@
+package natsx
+
+import (
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+type codecTestData struct {
+	Key   string `json:"key"`
+	Value int    `json:"value,omitempty"`
+	Skip  string `json:"-"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JsonCodec{}, MsgpackCodec{}} {
+		msg, err := EncodeMsg(codec, "test.codec", &codecTestData{Key: "k", Value: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.Get(HeaderContentType) != codec.ContentType() {
+			t.Fatalf("unexpected content type: %s", msg.Header.Get(HeaderContentType))
+		}
+		var out codecTestData
+		// fallback使用Raw，确认按消息头解码
+		if err := DecodeMsg(msg, &out, RawCodec{}); err != nil {
+			t.Fatal(err)
+		}
+		if out.Key != "k" || out.Value != 1 {
+			t.Fatalf("%s: unexpected result: %+v", codec.ContentType(), out)
+		}
+	}
+
+	msg, err := EncodeMsg(RawCodec{}, "test.codec", "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw string
+	if err := DecodeMsg(msg, &raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	if raw != "raw" {
+		t.Fatalf("unexpected raw result: %s", raw)
+	}
+}
+
+func TestMsgpackJsonTag(t *testing.T) {
+	data, err := MsgpackCodec{}.Encode("test.codec", &codecTestData{Key: "k", Skip: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := (MsgpackCodec{}).Decode("test.codec", data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields["key"] != "k" {
+		t.Fatalf("msgpack should follow json tags: %v", fields)
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	msg, err := EncodeMsg(ProtobufCodec{}, "test.codec", wrapperspb.String("proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &wrapperspb.StringValue{}
+	if err := DecodeMsg(msg, out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, wrapperspb.String("proto")) {
+		t.Fatalf("unexpected result: %v", out)
+	}
+	if _, err := EncodeMsg(ProtobufCodec{}, "test.codec", &codecTestData{}); !errors.Is(err, ErrInvalidProtobuf) {
+		t.Fatalf("expect invalid protobuf, got %v", err)
+	}
+	if err := DecodeMsg(msg, &codecTestData{}, nil); !errors.Is(err, ErrInvalidProtobuf) {
+		t.Fatalf("expect invalid protobuf, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// RetryPolicy 请求遇到没有响应者时的重试策略，重试不会超过ctx的截止时间
+type RetryPolicy struct {
+	// Attempts 最多尝试次数(含首次)，<=1时不重试
+	Attempts int
+	// Backoff 首次重试前的等待时间，之后每次翻倍直到MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy 服务滚动更新时通常在一秒内恢复
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: time.Millisecond * 100, MaxBackoff: time.Second}
+
+// SetRetryPolicy 设置带上下文的请求方法使用的重试策略，未设置时为DefaultRetryPolicy
+func (helper *NatsHelper) SetRetryPolicy(policy RetryPolicy) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.retryPolicy = &policy
+}
+
+func (helper *NatsHelper) getRetryPolicy() RetryPolicy {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	if helper.retryPolicy == nil {
+		return DefaultRetryPolicy
+	}
+	return *helper.retryPolicy
+}
+
+// PublishCtx 发送消息并注入追踪上下文，ctx已结束时不发送
+func (helper *NatsHelper) PublishCtx(ctx context.Context, subject string, data []byte) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	return helper.PublishMsgCtx(ctx, msg)
+}
+
+// PublishMsgCtx 发送带消息头的消息并注入追踪上下文
+func (helper *NatsHelper) PublishMsgCtx(ctx context.Context, msg *nats.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, span := startSpan(ctx, "nats publish", trace.SpanKindProducer, msg)
+	defer span.End()
+	err := helper.publishMsg(msg)
+	endSpan(span, err)
+	return err
+}
+
+// PublishEncodedCtx 编码后发送，可单独指定本次使用的编解码器
+func (helper *NatsHelper) PublishEncodedCtx(ctx context.Context, subject string, v any, codec ...Codec) error {
+	msg, err := EncodeMsg(helper.pickCodec(codec), subject, v)
+	if err != nil {
+		return err
+	}
+	return helper.PublishMsgCtx(ctx, msg)
+}
+
+// RequestCtx 请求直到收到应答或ctx结束，ctx没有截止时间时使用nats.DefaultTimeout
+// 没有响应者时按重试策略重试
+func (helper *NatsHelper) RequestCtx(ctx context.Context, subject string, data []byte) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	return helper.RequestMsgCtx(ctx, msg)
+}
+
+// RequestMsgCtx 与RequestCtx相同，发送带消息头的请求
+func (helper *NatsHelper) RequestMsgCtx(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.DefaultTimeout)
+		defer cancel()
+	}
+	ctx, span := startSpan(ctx, "nats request", trace.SpanKindClient, msg)
+	defer span.End()
+	if err := helper.checkSchemaOut(msg); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	if err := helper.checkOut(msg); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	policy := helper.getRetryPolicy()
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		reply, err := helper.Nc.RequestMsgWithContext(ctx, msg)
+		if !errors.Is(err, nats.ErrNoResponders) || attempt >= policy.Attempts {
+			endSpan(span, err)
+			return reply, err
+		}
+		span.AddEvent("no responders", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		select {
+		case <-ctx.Done():
+			// 返回更有意义的ErrNoResponders，而不是ctx的错误
+			endSpan(span, err)
+			return nil, err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// RequestJsonCtx 以JSON编解码的RequestEncodedCtx
+func (helper *NatsHelper) RequestJsonCtx(ctx context.Context, subject string, v any, vPtr any) error {
+	return helper.RequestEncodedCtx(ctx, subject, v, vPtr, JsonCodec{})
+}
+
+// RequestEncodedCtx 编码后请求，应答带有服务错误头时返回*ServiceErr
+func (helper *NatsHelper) RequestEncodedCtx(ctx context.Context, subject string, v any, vPtr any, codec ...Codec) error {
+	return requestEncoded(ctx, helper, helper.pickCodec(codec), subject, v, vPtr)
+}
+
+func requestEncoded(ctx context.Context, requester Requester, c Codec, subject string, v any, vPtr any) error {
+	msg, err := EncodeMsg(c, subject, v)
+	if err != nil {
+		return err
+	}
+	reply, err := requester.RequestMsgCtx(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if err := ServiceError(reply); err != nil {
+		return err
+	}
+	if mPtr, ok := vPtr.(*nats.Msg); ok {
+		*mPtr = *reply
+		return nil
+	}
+	return DecodeMsg(reply, vPtr, c)
+}
+
+// RequestAs 带类型的RequestEncodedCtx
+func RequestAs[T any](ctx context.Context, requester Requester, subject string, v any, codec ...Codec) (*T, error) {
+	var result T
+	if err := requester.RequestEncodedCtx(ctx, subject, v, &result, codec...); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// startSpan 创建Span并将追踪上下文注入消息头
+// name固定不含主题，避免Span名称的基数随主题增长
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, msg *nats.Msg) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(meterName).Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination", msg.Subject),
+			attribute.String("messaging.destination.name", msg.Subject),
+			attribute.Int("messaging.message.body.size", len(msg.Data)),
+		))
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+	return ctx, span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
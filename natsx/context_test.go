@@ -0,0 +1,104 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestCtx(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	helper, responder := connect(), connect()
+	helper.SetRetryPolicy(natsx.RetryPolicy{Attempts: 20, Backoff: time.Millisecond * 20, MaxBackoff: time.Millisecond * 50})
+
+	// 响应者在首次请求之后才上线，应通过重试拿到应答
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		_ = responder.AddNatsJSONHandler("test.ctx.echo", func(subject, reply string, v *codecData) {
+			_ = responder.PublishJson(reply, v)
+		})
+		_ = responder.AddNatsCtxHandler("test.ctx.fail", func(ctx context.Context, msg *nats.Msg) {
+			_ = natsx.RespondError(msg, http.StatusBadRequest, "bad key")
+		})
+		_ = responder.AddNatsCtxHandler("test.ctx.slow", func(ctx context.Context, msg *nats.Msg) {})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	got, err := natsx.RequestAs[codecData](ctx, helper, "test.ctx.echo", &codecData{Key: "k"})
+	if err != nil || got.Key != "k" {
+		t.Fatalf("unexpected reply: %+v, %v", got, err)
+	}
+
+	var serviceErr *natsx.ServiceErr
+	if err := helper.RequestJsonCtx(ctx, "test.ctx.fail", &codecData{}, &codecData{}); !errors.As(err, &serviceErr) || serviceErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected service error, got %v", err)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancelShort()
+	if _, err := helper.RequestCtx(short, "test.ctx.slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	cancelled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	if err := helper.PublishCtx(cancelled, "test.ctx.echo", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestRequestCtxSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(provider)
+
+	helper := natsxtest.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, subject := range []string{"test.span.1", "test.span.2"} {
+		if err := helper.PublishCtx(ctx, subject, nil); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = helper.RequestCtx(ctx, subject, nil)
+	}
+
+	// Span名称固定，主题记录在属性中
+	names := map[string]int{}
+	for _, span := range recorder.Ended() {
+		names[span.Name()]++
+		var destination string
+		for _, attr := range span.Attributes() {
+			if attr.Key == attribute.Key("messaging.destination") {
+				destination = attr.Value.AsString()
+			}
+		}
+		if destination != "test.span.1" && destination != "test.span.2" {
+			t.Fatalf("unexpected destination of %s: %q", span.Name(), destination)
+		}
+	}
+	if len(names) != 2 || names["nats publish"] != 2 || names["nats request"] != 2 {
+		t.Fatalf("unexpected span names: %v", names)
+	}
+}
+
+type codecData struct {
+	Key string `json:"key"`
+}
@@ -0,0 +1,287 @@
+package natsx
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DedupRecord 去重窗口内记录的处理状态，Done后Data与Header为首次处理的应答
+type DedupRecord struct {
+	Done   bool                `json:"done"`
+	Data   []byte              `json:"data,omitempty"`
+	Header map[string][]string `json:"header,omitempty"`
+}
+
+// DedupStore 去重存储
+type DedupStore interface {
+	// Reserve 占用key，成功时返回nil，key已存在时返回已有记录
+	Reserve(ctx context.Context, key string, window time.Duration) (*DedupRecord, error)
+	// Complete 记录处理完成及其应答
+	Complete(ctx context.Context, key string, record *DedupRecord, window time.Duration) error
+	// Release 处理失败时释放key，让重投的消息可以再次处理
+	Release(ctx context.Context, key string) error
+}
+
+type dedupOptions struct {
+	window time.Duration
+	key    func(msg *nats.Msg) string
+	scope  string
+}
+
+type DedupOption func(options *dedupOptions)
+
+// WithDedupWindow 去重窗口，KV存储使用桶的TTL，忽略该值
+func WithDedupWindow(window time.Duration) DedupOption {
+	return func(options *dedupOptions) {
+		options.window = window
+	}
+}
+
+// WithDedupKey 自定义消息ID的提取方式，返回空字符串时不做去重
+func WithDedupKey(key func(msg *nats.Msg) string) DedupOption {
+	return func(options *dedupOptions) {
+		options.key = key
+	}
+}
+
+// WithDedupScope 去重的作用域，默认为订阅主题，JetStream消息为流名与消费者名
+// 不同处理器处理同一条消息时应使用不同作用域
+func WithDedupScope(scope string) DedupOption {
+	return func(options *dedupOptions) {
+		options.scope = scope
+	}
+}
+
+// DefaultDedupKey 使用Nats-Msg-Id头，没有时对JetStream消息使用流名与流序号
+func DefaultDedupKey(msg *nats.Msg) string {
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		return fmt.Sprintf("%s.%d", meta.Stream, meta.Sequence.Stream)
+	}
+	return ""
+}
+
+// ReplyHandler 返回应答的处理器，返回*ServiceErr时使用其中的错误码，其他错误视为500
+type ReplyHandler func(ctx context.Context, msg *nats.Msg) (*nats.Msg, error)
+
+// ErrHandler 返回处理结果的处理器，返回错误表示处理失败
+type ErrHandler func(ctx context.Context, msg *nats.Msg) error
+
+type dedupFailedKey struct{}
+
+// DedupFailed 在Deduplicate中间件内标记本次处理失败，不记录为已处理
+// 处理器Nak、Term消息或处理失败但没有崩溃时需要调用，否则重投的消息会被当作重复跳过
+func DedupFailed(ctx context.Context) {
+	if failed, ok := ctx.Value(dedupFailedKey{}).(*atomic.Bool); ok {
+		failed.Store(true)
+	}
+}
+
+// Deduplicate 跳过去重窗口内已处理或正在处理的消息
+// 处理器崩溃或调用DedupFailed时释放记录，JetStream的重复消息会被直接确认
+func Deduplicate(store DedupStore, option ...DedupOption) Middleware {
+	opt := newDedupOptions(option)
+	return func(next MsgHandler) MsgHandler {
+		return deduplicate(store, opt, func(ctx context.Context, msg *nats.Msg) error {
+			failed := &atomic.Bool{}
+			next(context.WithValue(ctx, dedupFailedKey{}, failed), msg)
+			if failed.Load() {
+				return errDedupFailed
+			}
+			return nil
+		})
+	}
+}
+
+// DeduplicateFunc 与Deduplicate相同，处理器返回错误时释放记录
+func DeduplicateFunc(store DedupStore, handler ErrHandler, option ...DedupOption) MsgHandler {
+	return deduplicate(store, newDedupOptions(option), handler)
+}
+
+var errDedupFailed = errors.New("dedup handler failed")
+
+func deduplicate(store DedupStore, opt *dedupOptions, handler ErrHandler) MsgHandler {
+	return func(ctx context.Context, msg *nats.Msg) {
+		dedup(ctx, store, opt, msg, func() (*DedupRecord, error) {
+			if err := handler(ctx, msg); err != nil {
+				return nil, err
+			}
+			return &DedupRecord{Done: true}, nil
+		})
+	}
+}
+
+// Idempotent 幂等的请求处理器，窗口内的重复请求直接重放首次处理的应答
+// 处理失败时不缓存结果，重复请求会再次处理
+func Idempotent(store DedupStore, handler ReplyHandler, option ...DedupOption) MsgHandler {
+	opt := newDedupOptions(option)
+	return func(ctx context.Context, msg *nats.Msg) {
+		dedup(ctx, store, opt, msg, func() (*DedupRecord, error) {
+			reply, err := handler(ctx, msg)
+			if err != nil {
+				var serviceErr *ServiceErr
+				if !errors.As(err, &serviceErr) {
+					serviceErr = &ServiceErr{Code: http.StatusInternalServerError, Description: err.Error()}
+				}
+				_ = RespondError(msg, serviceErr.Code, serviceErr.Description)
+				return nil, err
+			}
+			record := &DedupRecord{Done: true}
+			if reply != nil {
+				record.Data, record.Header = reply.Data, reply.Header
+				if record.Data == nil {
+					record.Data = []byte{} // 空应答也需要重放
+				}
+			}
+			respondRecord(ctx, msg, record)
+			return record, nil
+		})
+	}
+}
+
+func newDedupOptions(option []DedupOption) *dedupOptions {
+	opt := &dedupOptions{
+		window: time.Minute * 2, // 与JetStream流默认的去重窗口一致
+		key:    DefaultDedupKey,
+	}
+	for _, o := range option {
+		o(opt)
+	}
+	return opt
+}
+
+func dedup(ctx context.Context, store DedupStore, opt *dedupOptions, msg *nats.Msg, process func() (*DedupRecord, error)) {
+	id := opt.key(msg)
+	if id == "" {
+		_, _ = process()
+		return
+	}
+	scope := opt.scope
+	if scope == "" {
+		scope = subscriptionSubject(msg)
+		if meta, err := msg.Metadata(); err == nil {
+			// 推送消费者的订阅主题为随机的投递主题
+			scope = meta.Stream + "." + meta.Consumer
+		}
+	}
+	key := scope + ":" + id
+	existing, err := store.Reserve(ctx, key, opt.window)
+	if err != nil {
+		// 无法确认是否重复时不处理，JetStream消息会在AckWait后重投
+		utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to reserve dedup key %s: %v", key, err))
+		_ = RespondError(msg, http.StatusServiceUnavailable, "deduplication store unavailable")
+		return
+	}
+	if existing != nil {
+		if !existing.Done {
+			// 首次处理尚未完成，不确认消息，由其结果决定是否需要重投
+			_ = RespondError(msg, http.StatusConflict, "duplicate message in progress")
+			return
+		}
+		if isJetStreamMsg(msg) {
+			_ = msg.Ack()
+		}
+		respondRecord(ctx, msg, existing)
+		return
+	}
+
+	var record *DedupRecord
+	defer func() {
+		if r := recover(); r != nil {
+			release(ctx, store, key)
+			panic(r)
+		}
+		if record == nil {
+			release(ctx, store, key)
+			return
+		}
+		if err := store.Complete(ctx, key, record, opt.window); err != nil {
+			utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to complete dedup key %s: %v", key, err))
+		}
+	}()
+	record, _ = process()
+}
+
+func release(ctx context.Context, store DedupStore, key string) {
+	if err := store.Release(ctx, key); err != nil {
+		utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to release dedup key %s: %v", key, err))
+	}
+}
+
+func respondRecord(ctx context.Context, msg *nats.Msg, record *DedupRecord) {
+	if msg.Reply == "" || isJetStreamMsg(msg) || (record.Data == nil && record.Header == nil) {
+		return
+	}
+	reply := nats.NewMsg(msg.Reply)
+	reply.Data = record.Data
+	for k, v := range record.Header {
+		reply.Header[k] = v
+	}
+	if err := RespondMsg(msg, reply); err != nil {
+		utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to respond %s: %v", msg.Subject, err))
+	}
+}
+
+func isJetStreamMsg(msg *nats.Msg) bool {
+	_, err := msg.Metadata()
+	return err == nil
+}
+
+// KVDedupStore 基于JetStream KV桶的去重存储，窗口为桶的TTL
+type KVDedupStore struct {
+	kv *KV[DedupRecord]
+}
+
+// NewKVDedupStore 绑定或创建TTL为window的桶
+func NewKVDedupStore(helper *NatsHelper, bucket string, window time.Duration) (*KVDedupStore, error) {
+	kv, err := NewKV[DedupRecord](helper, &nats.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "natsx message deduplication",
+		TTL:         window,
+	}, JsonCodec{})
+	if err != nil {
+		return nil, err
+	}
+	return &KVDedupStore{kv: kv}, nil
+}
+
+// kvKey 消息ID中可能含有KV键不允许的字符
+func (s *KVDedupStore) kvKey(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func (s *KVDedupStore) Reserve(_ context.Context, key string, _ time.Duration) (*DedupRecord, error) {
+	_, err := s.kv.Create(s.kvKey(key), DedupRecord{})
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return nil, err
+	}
+	entry, err := s.kv.Get(s.kvKey(key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return &DedupRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry.Value, nil
+}
+
+func (s *KVDedupStore) Complete(_ context.Context, key string, record *DedupRecord, _ time.Duration) error {
+	_, err := s.kv.Put(s.kvKey(key), *record)
+	return err
+}
+
+func (s *KVDedupStore) Release(_ context.Context, key string) error {
+	return s.kv.Store.Purge(s.kvKey(key))
+}
@@ -0,0 +1,134 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKVDedupStore(t *testing.T) {
+	helper := natsxtest.New(t)
+	ctx := context.Background()
+	window := time.Second
+	store, err := natsx.NewKVDedupStore(helper, "test_dedup", window)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 并发首次出现时只有一个调用占用成功
+	var (
+		first atomic.Int32
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record, err := store.Reserve(ctx, "test.dedup:1", window)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if record == nil {
+				first.Add(1)
+			} else if record.Done {
+				t.Error("record should be pending")
+			}
+		}()
+	}
+	wg.Wait()
+	if first.Load() != 1 {
+		t.Fatalf("expect one first-seen reservation, got %d", first.Load())
+	}
+
+	if err := store.Complete(ctx, "test.dedup:1", &natsx.DedupRecord{Done: true, Data: []byte("ok")}, window); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Reserve(ctx, "test.dedup:1", window); err != nil || record == nil || !record.Done || string(record.Data) != "ok" {
+		t.Fatalf("unexpected completed record: %+v, %v", record, err)
+	}
+
+	// 释放后可以再次占用，消息ID中的特殊字符不影响键
+	if record, err := store.Reserve(ctx, "test.dedup:a b/*", window); err != nil || record != nil {
+		t.Fatalf("unexpected reservation: %+v, %v", record, err)
+	}
+	if err := store.Release(ctx, "test.dedup:a b/*"); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Reserve(ctx, "test.dedup:a b/*", window); err != nil || record != nil {
+		t.Fatalf("released key should be reserved again: %+v, %v", record, err)
+	}
+
+	// 超过窗口后记录过期
+	waitFor(t, func() bool {
+		record, err := store.Reserve(ctx, "test.dedup:1", window)
+		return err == nil && record == nil
+	})
+}
+
+func TestDeduplicateNak(t *testing.T) {
+	helper := natsxtest.New(t)
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "DEDUP", Subjects: []string{"dedup.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := natsx.NewKVDedupStore(helper, "test_dedup_nak", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 首次投递Nak，重投的消息不应被当作重复跳过
+	var calls atomic.Int32
+	done := make(chan struct{})
+	handlers := map[string]natsx.MsgHandler{
+		"dedup.func": natsx.DeduplicateFunc(store, func(ctx context.Context, msg *nats.Msg) error {
+			if calls.Add(1) == 1 {
+				_ = msg.Nak()
+				return errors.New("not ready")
+			}
+			_ = msg.Ack()
+			return nil
+		}),
+		"dedup.middleware": natsx.Deduplicate(store)(func(ctx context.Context, msg *nats.Msg) {
+			if calls.Add(1) == 1 {
+				_ = msg.Nak()
+				natsx.DedupFailed(ctx)
+				return
+			}
+			_ = msg.Ack()
+		}),
+	}
+	for subject, handler := range handlers {
+		calls.Store(0)
+		handler := handler
+		sub, err := helper.Js.Subscribe(subject, func(msg *nats.Msg) {
+			handler(context.Background(), msg)
+			if calls.Load() == 2 {
+				done <- struct{}{}
+			}
+		}, nats.Durable(strings.ReplaceAll(subject, ".", "_")), nats.ManualAck())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := helper.Js.Publish(subject, []byte("1"), nats.MsgId(subject)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s: redelivery was not handled, calls %d", subject, calls.Load())
+		}
+		_ = sub.Unsubscribe()
+		if calls.Load() != 2 {
+			t.Fatalf("%s: expect 2 calls, got %d", subject, calls.Load())
+		}
+		if record, err := store.Reserve(context.Background(), "DEDUP."+strings.ReplaceAll(subject, ".", "_")+":"+subject, time.Minute); err != nil || record == nil || !record.Done {
+			t.Fatalf("%s: record should be done after success: %+v, %v", subject, record, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryDedupStore struct {
+	lock    sync.Mutex
+	records map[string]*DedupRecord
+}
+
+func (s *memoryDedupStore) Reserve(_ context.Context, key string, _ time.Duration) (*DedupRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if record, ok := s.records[key]; ok {
+		return record, nil
+	}
+	s.records[key] = &DedupRecord{}
+	return nil, nil
+}
+
+func (s *memoryDedupStore) Complete(_ context.Context, key string, record *DedupRecord, _ time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.records[key] = record
+	return nil
+}
+
+func (s *memoryDedupStore) Release(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func TestDeduplicate(t *testing.T) {
+	store := &memoryDedupStore{records: make(map[string]*DedupRecord)}
+	var calls int
+	fail := true
+	handler := Deduplicate(store)(func(ctx context.Context, msg *nats.Msg) {
+		calls++
+		if fail {
+			fail = false
+			panic("first attempt failed")
+		}
+	})
+	newMsg := func(id string) *nats.Msg {
+		msg := nats.NewMsg("test.dedup")
+		msg.Header.Set(nats.MsgIdHdr, id)
+		return msg
+	}
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+		handler(context.Background(), newMsg("1"))
+	}()
+	// 崩溃后应释放记录，重投的消息会再次处理
+	handler(context.Background(), newMsg("1"))
+	handler(context.Background(), newMsg("1"))
+	handler(context.Background(), newMsg("2"))
+	if calls != 3 {
+		t.Fatalf("unexpected handler calls: %d", calls)
+	}
+	if record := store.records["test.dedup:1"]; record == nil || !record.Done {
+		t.Fatalf("unexpected dedup record: %+v", record)
+	}
+
+	// 处理失败时释放记录
+	failed := Deduplicate(store)(func(ctx context.Context, msg *nats.Msg) {
+		calls++
+		DedupFailed(ctx)
+	})
+	failed(context.Background(), newMsg("3"))
+	failed(context.Background(), newMsg("3"))
+	errored := DeduplicateFunc(store, func(ctx context.Context, msg *nats.Msg) error {
+		calls++
+		return errors.New("failed")
+	})
+	errored(context.Background(), newMsg("4"))
+	errored(context.Background(), newMsg("4"))
+	if calls != 7 || store.records["test.dedup:3"] != nil || store.records["test.dedup:4"] != nil {
+		t.Fatalf("failed messages should be released: calls %d, records %v", calls, store.records)
+	}
+}
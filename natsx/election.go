@@ -0,0 +1,315 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"k8s.io/klog/v2"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked 锁已被其他持有者占用
+	ErrLocked = errors.New("nats lock is held by another owner")
+	// ErrNotLocked 锁已过期或已被其他持有者获取
+	ErrNotLocked = errors.New("nats lock is not held")
+)
+
+// newTTLKV 绑定或创建带TTL的存储桶，已有桶时使用其TTL
+func newTTLKV(helper *NatsHelper, bucket string, ttl time.Duration) (*KV[string], time.Duration, error) {
+	kv, err := NewKV[string](helper, &nats.KeyValueConfig{Bucket: bucket, TTL: ttl, History: 1}, RawCodec{})
+	if err != nil {
+		return nil, 0, err
+	}
+	status, err := kv.Store.Status()
+	if err != nil {
+		return nil, 0, err
+	}
+	if status.TTL() <= 0 {
+		return nil, 0, fmt.Errorf("kv bucket %s has no ttl", bucket)
+	}
+	return kv, status.TTL(), nil
+}
+
+type electionOptions struct {
+	id        string
+	onElected func(ctx context.Context)
+	onRevoked func()
+}
+
+type ElectionOption func(options *electionOptions)
+
+// WithElectionId 候选者标识，默认随机生成
+func WithElectionId(id string) ElectionOption {
+	return func(options *electionOptions) {
+		options.id = id
+	}
+}
+
+// WithOnElected 当选时在新协程中调用，ctx会在失去领导权时取消
+func WithOnElected(onElected func(ctx context.Context)) ElectionOption {
+	return func(options *electionOptions) {
+		options.onElected = onElected
+	}
+}
+
+// WithOnRevoked 失去领导权时在新协程中调用，包括Campaign的ctx结束与Resign
+func WithOnRevoked(onRevoked func()) ElectionOption {
+	return func(options *electionOptions) {
+		options.onRevoked = onRevoked
+	}
+}
+
+// Election 基于KV键的领导者选举，领导者需在TTL内续期，否则其他候选者可以当选
+type Election struct {
+	kv  *KV[string]
+	key string
+	ttl time.Duration
+	opt *electionOptions
+
+	lock      sync.Mutex
+	revision  uint64
+	campaign  *campaign
+	revokeCtx context.CancelFunc
+}
+
+// campaign 一次参选的后台协程
+type campaign struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error // 结束时删除选举键的错误，done关闭后可读
+}
+
+// NewElection 在bucket中以key进行选举，ttl为桶的TTL，桶已存在时使用其TTL
+// 选举会在helper.Close时放弃
+func NewElection(helper *NatsHelper, bucket, key string, ttl time.Duration, option ...ElectionOption) (*Election, error) {
+	opt := &electionOptions{id: nuid.Next()}
+	for _, o := range option {
+		o(opt)
+	}
+	kv, ttl, err := newTTLKV(helper, bucket, ttl)
+	if err != nil {
+		return nil, err
+	}
+	e := &Election{kv: kv, key: key, ttl: ttl, opt: opt}
+	helper.addCloser(func() {
+		if err := e.Resign(); err != nil {
+			klog.Errorf("failed to resign election %s: %v", key, err)
+		}
+	})
+	return e, nil
+}
+
+// Id 当前候选者标识
+func (e *Election) Id() string {
+	return e.opt.id
+}
+
+// Campaign 开始参选，在后台持续尝试当选与续期，直到ctx结束或调用Resign
+func (e *Election) Campaign(ctx context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.campaign != nil {
+		return errors.New("election campaign already started")
+	}
+	watcher, err := e.kv.Store.Watch(e.key)
+	if err != nil {
+		return err
+	}
+	c := &campaign{done: make(chan struct{})}
+	ctx, c.cancel = context.WithCancel(ctx)
+	e.campaign = c
+	go e.run(ctx, watcher, c)
+	return nil
+}
+
+func (e *Election) run(ctx context.Context, watcher nats.KeyWatcher, c *campaign) {
+	defer close(c.done)
+	defer func() {
+		c.err = e.stop(c)
+	}()
+	defer func() {
+		_ = watcher.Stop()
+	}()
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	updates := watcher.Updates()
+	for {
+		e.tick(ctx)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				break wait
+			case entry, ok := <-updates:
+				if !ok {
+					updates = nil
+					continue
+				}
+				// 续期与其他候选者的写入由ticker处理，只有领导者放弃时立即参选
+				if entry != nil && entry.Operation() != nats.KeyValuePut {
+					break wait
+				}
+			}
+		}
+	}
+}
+
+func (e *Election) tick(ctx context.Context) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.revision != 0 {
+		revision, err := e.kv.Update(e.key, e.opt.id, e.revision)
+		if err != nil {
+			klog.Warningf("election %s: failed to renew leadership: %v", e.key, err)
+			e.revoked()
+			return
+		}
+		e.revision = revision
+		return
+	}
+	revision, err := e.kv.Create(e.key, e.opt.id)
+	if err != nil {
+		if !errors.Is(err, nats.ErrKeyExists) {
+			klog.Warningf("election %s: failed to campaign: %v", e.key, err)
+		}
+		return
+	}
+	e.revision = revision
+	klog.Infof("election %s: %s elected", e.key, e.opt.id)
+	if e.opt.onElected != nil {
+		var electedCtx context.Context
+		electedCtx, e.revokeCtx = context.WithCancel(ctx)
+		go e.opt.onElected(electedCtx)
+	}
+}
+
+// stop 参选结束时放弃领导权，是领导者时删除选举键让其他候选者尽快当选
+func (e *Election) stop(c *campaign) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.campaign == c {
+		e.campaign = nil
+	}
+	if e.revision == 0 {
+		return nil
+	}
+	err := e.kv.Delete(e.key, nats.LastRevision(e.revision))
+	e.revoked()
+	return err
+}
+
+// revoked 需持有e.lock，回调在新协程中执行，可以调用IsLeader、Resign等方法
+func (e *Election) revoked() {
+	e.revision = 0
+	klog.Infof("election %s: %s revoked", e.key, e.opt.id)
+	if e.revokeCtx != nil {
+		e.revokeCtx()
+		e.revokeCtx = nil
+	}
+	if e.opt.onRevoked != nil {
+		go e.opt.onRevoked()
+	}
+}
+
+// IsLeader 当前是否为领导者
+func (e *Election) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.revision != 0
+}
+
+// Leader 当前领导者的标识，没有领导者时返回nats.ErrKeyNotFound
+func (e *Election) Leader() (string, error) {
+	entry, err := e.kv.Get(e.key)
+	if err != nil {
+		return "", err
+	}
+	return entry.Value, nil
+}
+
+// Resign 停止参选，是领导者时删除选举键让其他候选者尽快当选
+func (e *Election) Resign() error {
+	e.lock.Lock()
+	c := e.campaign
+	e.lock.Unlock()
+	if c == nil {
+		return nil
+	}
+	c.cancel()
+	<-c.done
+	return c.err
+}
+
+// Locker 基于KV键的分布式锁，适用于较短的临界区
+// 持有时间超过桶的TTL后锁会自动释放
+type Locker struct {
+	kv   *KV[string]
+	ttl  time.Duration
+	wait time.Duration
+}
+
+// NewLocker 在bucket中创建锁，ttl为桶的TTL，桶已存在时使用其TTL
+func NewLocker(helper *NatsHelper, bucket string, ttl time.Duration) (*Locker, error) {
+	kv, ttl, err := newTTLKV(helper, bucket, ttl)
+	if err != nil {
+		return nil, err
+	}
+	wait := ttl / 20
+	if wait > time.Millisecond*200 {
+		wait = time.Millisecond * 200
+	}
+	return &Locker{kv: kv, ttl: ttl, wait: wait}, nil
+}
+
+// Lock 获取的锁
+// Token为单调递增的防护令牌，写入外部资源时附带并拒绝更小的令牌，可避免过期持有者的写入
+type Lock struct {
+	Token  uint64
+	Name   string
+	Expire time.Time
+	locker *Locker
+}
+
+// TryLock 尝试获取锁，已被占用时返回ErrLocked
+func (l *Locker) TryLock(name string) (*Lock, error) {
+	owner := nuid.Next()
+	start := time.Now()
+	revision, err := l.kv.Create(name, owner)
+	if errors.Is(err, nats.ErrKeyExists) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Lock{Token: revision, Name: name, Expire: start.Add(l.ttl), locker: l}, nil
+}
+
+// Lock 获取锁，被占用时等待直到ctx结束
+func (l *Locker) Lock(ctx context.Context, name string) (*Lock, error) {
+	for {
+		lock, err := l.TryLock(name)
+		if !errors.Is(err, ErrLocked) {
+			return lock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.wait):
+		}
+	}
+}
+
+// Unlock 释放锁，锁已过期并被他人获取时返回ErrNotLocked
+func (lk *Lock) Unlock() error {
+	err := lk.locker.kv.Delete(lk.Name, nats.LastRevision(lk.Token))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return ErrNotLocked
+	}
+	return err
+}
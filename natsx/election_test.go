@@ -0,0 +1,185 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestElection(t *testing.T) {
+	helper := natsxtest.New(t)
+	var elected atomic.Int32
+	newCandidate := func(id string) *natsx.Election {
+		e, err := natsx.NewElection(helper, "test_election", "cleanup", time.Second*3,
+			natsx.WithElectionId(id),
+			natsx.WithOnElected(func(ctx context.Context) {
+				elected.Add(1)
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	a, b := newCandidate("a"), newCandidate("b")
+	if err := a.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, a.IsLeader)
+	if err := b.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := b.Leader(); err != nil || leader != "a" {
+		t.Fatalf("unexpected leader: %s, %v", leader, err)
+	}
+	if b.IsLeader() {
+		t.Fatal("b should not be leader")
+	}
+
+	if err := a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	// 放弃后应通过watch立即切换，而不是等待TTL
+	start := time.Now()
+	waitFor(t, b.IsLeader)
+	if time.Since(start) > time.Second {
+		t.Fatalf("failover took %s", time.Since(start))
+	}
+	// onElected在新协程中调用
+	waitFor(t, func() bool { return elected.Load() == 2 })
+}
+
+func TestElectionRenewal(t *testing.T) {
+	helper := natsxtest.New(t)
+	e, err := natsx.NewElection(helper, "test_renewal", "leader", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, e.IsLeader)
+	time.Sleep(time.Second * 3)
+	kv, err := helper.Js.KeyValue("test_renewal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := kv.Get("leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TTL/3续期一次，3个TTL内约10次，自身的续期不能再触发续期
+	if entry.Revision() > 20 {
+		t.Fatalf("too many renewals: revision %d", entry.Revision())
+	}
+	if !e.IsLeader() {
+		t.Fatal("leadership lost")
+	}
+}
+
+func TestElectionContext(t *testing.T) {
+	helper := natsxtest.New(t)
+	var e *natsx.Election
+	revoked := make(chan bool, 4)
+	e, err := natsx.NewElection(helper, "test_election_ctx", "leader", time.Second*3,
+		natsx.WithOnRevoked(func() {
+			// 回调中可以调用选举的方法
+			_, _ = e.Leader()
+			isLeader := e.IsLeader()
+			_ = e.Resign()
+			revoked <- isLeader
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRevoked := func() {
+		t.Helper()
+		select {
+		case isLeader := <-revoked:
+			if isLeader {
+				t.Fatal("should not be leader in onRevoked")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("onRevoked not called")
+		}
+	}
+
+	// ctx结束时放弃领导权并删除选举键
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := e.Campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, e.IsLeader)
+	cancel()
+	waitRevoked()
+	if e.IsLeader() {
+		t.Fatal("leadership should be revoked after ctx done")
+	}
+	if _, err := e.Leader(); !errors.Is(err, nats.ErrKeyNotFound) {
+		t.Fatalf("election key should be deleted, got %v", err)
+	}
+
+	// 可以再次参选，续期失败时回调中调用Resign不会死锁
+	if err := e.Campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, e.IsLeader)
+	kv, err := helper.Js.KeyValue("test_election_ctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("leader", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	waitRevoked()
+	if err := e.Campaign(context.Background()); err != nil {
+		t.Fatalf("campaign should be stopped by Resign in onRevoked: %v", err)
+	}
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocker(t *testing.T) {
+	helper := natsxtest.New(t)
+	locker, err := natsx.NewLocker(helper, "test_locks", time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := locker.TryLock("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := locker.TryLock("report"); !errors.Is(err, natsx.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	acquired := make(chan *natsx.Lock)
+	go func() {
+		lock, err := locker.Lock(ctx, "report")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lock
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	second := <-acquired
+	if second == nil || second.Token <= first.Token {
+		t.Fatalf("fencing token should increase: %d -> %+v", first.Token, second)
+	}
+	if err := first.Unlock(); !errors.Is(err, natsx.ErrNotLocked) {
+		t.Fatalf("stale unlock should fail with ErrNotLocked, got %v", err)
+	}
+	if err := second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,134 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+	"time"
+)
+
+// KVEntry 解码后的键值记录
+type KVEntry[T any] struct {
+	Bucket    string
+	Key       string
+	Value     T
+	Revision  uint64
+	Created   time.Time
+	Delta     uint64
+	Operation nats.KeyValueOp
+}
+
+// KV 带类型的JetStream Key-Value存储
+type KV[T any] struct {
+	Store    nats.KeyValue
+	codec    Codec
+	watchers watcherSet
+}
+
+// NewKV 创建或绑定已有的存储桶，值默认使用helper的编解码器
+// 返回的KV会在helper.Close时自动关闭
+func NewKV[T any](helper *NatsHelper, cfg *nats.KeyValueConfig, codec ...Codec) (*KV[T], error) {
+	store, err := helper.Js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		klog.V(1).Infof("creating kv bucket: %s", cfg.Bucket)
+		store, err = helper.Js.CreateKeyValue(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kv := &KV[T]{
+		Store: store,
+		codec: helper.pickCodec(codec),
+	}
+	helper.addCloser(kv.Close)
+	return kv, nil
+}
+
+func (kv *KV[T]) decodeEntry(entry nats.KeyValueEntry) (*KVEntry[T], error) {
+	e := &KVEntry[T]{
+		Bucket:    entry.Bucket(),
+		Key:       entry.Key(),
+		Revision:  entry.Revision(),
+		Created:   entry.Created(),
+		Delta:     entry.Delta(),
+		Operation: entry.Operation(),
+	}
+	if entry.Operation() == nats.KeyValuePut {
+		if err := kv.codec.Decode(entry.Key(), entry.Value(), &e.Value); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Get 获取键的最新值，不存在时返回nats.ErrKeyNotFound
+func (kv *KV[T]) Get(key string) (*KVEntry[T], error) {
+	entry, err := kv.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return kv.decodeEntry(entry)
+}
+
+// Put 写入值并返回新的版本号
+func (kv *KV[T]) Put(key string, value T) (uint64, error) {
+	data, err := kv.codec.Encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Store.Put(key, data)
+}
+
+// Create 仅在键不存在时写入
+func (kv *KV[T]) Create(key string, value T) (uint64, error) {
+	data, err := kv.codec.Encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Store.Create(key, data)
+}
+
+// Update 仅在最新版本号等于revision时写入
+func (kv *KV[T]) Update(key string, value T, revision uint64) (uint64, error) {
+	data, err := kv.codec.Encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Store.Update(key, data, revision)
+}
+
+func (kv *KV[T]) Delete(key string, opts ...nats.DeleteOpt) error {
+	return kv.Store.Delete(key, opts...)
+}
+
+// Keys 列出所有键，存储桶为空时返回空列表
+func (kv *KV[T]) Keys() ([]string, error) {
+	keys, err := kv.Store.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return []string{}, nil
+	}
+	return keys, err
+}
+
+// Watch 监听匹配keys(可含通配符)的变更，先推送当前值，之后推送后续更新
+// ctx结束或KV关闭时停止监听并关闭通道
+func (kv *KV[T]) Watch(ctx context.Context, keys string, opts ...nats.WatchOpt) (<-chan KVEntry[T], error) {
+	watcher, err := kv.Store.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return forward(ctx, &kv.watchers, watcher, watcher.Updates(), func(entry nats.KeyValueEntry) (KVEntry[T], bool) {
+		e, err := kv.decodeEntry(entry)
+		if err != nil {
+			klog.Errorf("failed to decode kv entry %s/%s: %v", entry.Bucket(), entry.Key(), err)
+			return KVEntry[T]{}, false
+		}
+		return *e, true
+	})
+}
+
+// Close 停止所有监听
+func (kv *KV[T]) Close() {
+	kv.watchers.close()
+}
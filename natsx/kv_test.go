@@ -0,0 +1,95 @@
+package natsx_test
+
+import (
+	"context"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+type kvTestValue struct {
+	Name string `json:"name"`
+}
+
+func nextEntry[T any](t *testing.T, ch <-chan natsx.KVEntry[T]) natsx.KVEntry[T] {
+	t.Helper()
+	select {
+	case entry, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return entry
+	case <-time.After(time.Second * 5):
+		t.Fatal("no watch update")
+	}
+	panic("unreachable")
+}
+
+func waitClosed[T any](t *testing.T, ch <-chan natsx.KVEntry[T]) {
+	t.Helper()
+	deadline := time.After(time.Second * 5)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("watch channel not closed")
+		}
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	helper := natsxtest.New(t)
+	kv, err := natsx.NewKV[kvTestValue](helper, &nats.KeyValueConfig{Bucket: "test_watch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("users.1", kvTestValue{Name: "init"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := kv.Watch(ctx, "users.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先推送当前值，再推送后续更新与删除
+	if entry := nextEntry(t, updates); entry.Key != "users.1" || entry.Value.Name != "init" {
+		t.Fatalf("unexpected initial entry: %+v", entry)
+	}
+	if _, err := kv.Put("users.2", kvTestValue{Name: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Put("orders.1", kvTestValue{Name: "ignored"}); err != nil {
+		t.Fatal(err)
+	}
+	if entry := nextEntry(t, updates); entry.Key != "users.2" || entry.Value.Name != "new" || entry.Operation != nats.KeyValuePut {
+		t.Fatalf("unexpected update: %+v", entry)
+	}
+	if err := kv.Delete("users.1"); err != nil {
+		t.Fatal(err)
+	}
+	if entry := nextEntry(t, updates); entry.Key != "users.1" || entry.Operation != nats.KeyValueDelete {
+		t.Fatalf("unexpected delete: %+v", entry)
+	}
+
+	// ctx结束时停止
+	cancel()
+	waitClosed(t, updates)
+
+	// KV关闭时停止所有监听，之后无法再监听
+	updates, err = kv.Watch(context.Background(), ">")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+	waitClosed(t, updates)
+	if _, err := kv.Watch(context.Background(), ">"); err == nil {
+		t.Fatal("watch after close should fail")
+	}
+}
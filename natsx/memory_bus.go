@@ -0,0 +1,402 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryBus 进程内的消息总线，支持通配符、队列组与请求应答，用于在没有服务器时测试业务代码
+// 与NATS一致，每个订阅按发送顺序在各自的goroutine中处理消息，Flush等待所有已发送的消息处理完成
+// 不支持ClaimCheck、schema校验与JetStream
+type MemoryBus struct {
+	lock        sync.RWMutex
+	subs        []*memorySub
+	codec       Codec
+	middlewares []Middleware
+	closed      bool
+	next        atomic.Uint64
+	// replies 登记在memoryReplies中的应答主题，收到应答、请求结束、消息处理完成或关闭时移除
+	replies map[string]struct{}
+
+	pendingLock sync.Mutex
+	pendingCond *sync.Cond
+	pending     int
+}
+
+type memorySub struct {
+	subject string
+	queue   string
+	handler MsgHandler
+
+	lock   sync.Mutex
+	msgs   []memoryMsg
+	closed bool
+	signal chan struct{}
+	done   chan struct{}
+}
+
+// memoryMsg 待处理的消息，delivery为nil时不需要移除应答主题的登记
+type memoryMsg struct {
+	msg      *nats.Msg
+	delivery *memoryDelivery
+}
+
+// memoryDelivery 带应答主题的一次发送，全部订阅处理完成后移除应答主题的登记
+type memoryDelivery struct {
+	bus     *MemoryBus
+	reply   string
+	pending atomic.Int32
+}
+
+func (d *memoryDelivery) done() {
+	if d != nil && d.pending.Add(-1) == 0 {
+		d.bus.forgetReply(d.reply)
+	}
+}
+
+// NewMemoryBus 创建进程内消息总线
+func NewMemoryBus() *MemoryBus {
+	bus := &MemoryBus{replies: make(map[string]struct{})}
+	bus.pendingCond = sync.NewCond(&bus.pendingLock)
+	return bus
+}
+
+// SetCodec 设置默认编解码器，未设置时为JSON
+func (bus *MemoryBus) SetCodec(codec Codec) {
+	bus.codec = codec
+}
+
+// Codec 当前默认编解码器
+func (bus *MemoryBus) Codec() Codec {
+	if bus.codec == nil {
+		return JsonCodec{}
+	}
+	return bus.codec
+}
+
+func (bus *MemoryBus) pickCodec(codec []Codec) Codec {
+	if len(codec) > 0 && codec[0] != nil {
+		return codec[0]
+	}
+	return bus.Codec()
+}
+
+// Use 添加中间件，先添加的在外层，只对之后注册的处理器生效
+func (bus *MemoryBus) Use(middleware ...Middleware) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.middlewares = append(bus.middlewares, middleware...)
+}
+
+// Close 取消所有订阅，未处理的消息被丢弃
+func (bus *MemoryBus) Close() {
+	bus.lock.Lock()
+	subs := bus.subs
+	bus.subs, bus.closed = nil, true
+	for reply := range bus.replies {
+		memoryReplies.CompareAndDelete(reply, bus)
+	}
+	clear(bus.replies)
+	bus.lock.Unlock()
+	for _, sub := range subs {
+		sub.stop(bus)
+	}
+}
+
+// Flush 等待所有已发送的消息处理完成，包括处理过程中发送的消息
+func (bus *MemoryBus) Flush() {
+	bus.pendingLock.Lock()
+	defer bus.pendingLock.Unlock()
+	for bus.pending > 0 {
+		bus.pendingCond.Wait()
+	}
+}
+
+func (bus *MemoryBus) addPending(n int) {
+	bus.pendingLock.Lock()
+	defer bus.pendingLock.Unlock()
+	bus.pending += n
+	if bus.pending == 0 {
+		bus.pendingCond.Broadcast()
+	}
+}
+
+func (bus *MemoryBus) PublishCtx(ctx context.Context, subject string, data []byte) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	return bus.PublishMsgCtx(ctx, msg)
+}
+
+func (bus *MemoryBus) PublishMsgCtx(ctx context.Context, msg *nats.Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := bus.publish(msg, true)
+	return err
+}
+
+func (bus *MemoryBus) PublishEncodedCtx(ctx context.Context, subject string, v any, codec ...Codec) error {
+	msg, err := EncodeMsg(bus.pickCodec(codec), subject, v)
+	if err != nil {
+		return err
+	}
+	return bus.PublishMsgCtx(ctx, msg)
+}
+
+// publish 投递消息并返回接收的订阅数
+// track为true时登记应答主题，在全部订阅处理完成后移除，处理器需在返回前应答
+func (bus *MemoryBus) publish(msg *nats.Msg, track bool) (int, error) {
+	if msg.Subject == "" || strings.ContainsAny(msg.Subject, "*> \t\r\n") {
+		return 0, nats.ErrBadSubject
+	}
+	bus.lock.RLock()
+	if bus.closed {
+		bus.lock.RUnlock()
+		return 0, nats.ErrConnectionClosed
+	}
+	var targets []*memorySub
+	groups := make(map[string][]*memorySub)
+	for _, sub := range bus.subs {
+		if !subjectMatches(sub.subject, msg.Subject) {
+			continue
+		}
+		if sub.queue == "" {
+			targets = append(targets, sub)
+		} else {
+			groups[sub.queue] = append(groups[sub.queue], sub)
+		}
+	}
+	bus.lock.RUnlock()
+	// 队列组内轮流投递
+	for _, members := range groups {
+		targets = append(targets, members[bus.next.Add(1)%uint64(len(members))])
+	}
+	var delivery *memoryDelivery
+	if track && msg.Reply != "" && len(targets) > 0 {
+		delivery = &memoryDelivery{bus: bus, reply: msg.Reply}
+		delivery.pending.Store(int32(len(targets)))
+		bus.trackReply(msg.Reply)
+	}
+	bus.addPending(len(targets))
+	for _, sub := range targets {
+		if !sub.push(memoryMsg{msg: copyMsg(msg), delivery: delivery}) {
+			delivery.done()
+			bus.addPending(-1)
+		}
+	}
+	return len(targets), nil
+}
+
+// trackReply 登记应答主题，使RespondMsg能找到总线
+func (bus *MemoryBus) trackReply(reply string) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.closed {
+		return
+	}
+	bus.replies[reply] = struct{}{}
+	memoryReplies.Store(reply, bus)
+}
+
+// forgetReply 移除应答主题的登记
+func (bus *MemoryBus) forgetReply(reply string) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	delete(bus.replies, reply)
+	memoryReplies.CompareAndDelete(reply, bus)
+}
+
+func copyMsg(msg *nats.Msg) *nats.Msg {
+	m := &nats.Msg{Subject: msg.Subject, Reply: msg.Reply, Data: slices.Clone(msg.Data), Header: nats.Header{}}
+	for k, v := range msg.Header {
+		m.Header[k] = slices.Clone(v)
+	}
+	return m
+}
+
+func (bus *MemoryBus) RequestCtx(ctx context.Context, subject string, data []byte) (*nats.Msg, error) {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	return bus.RequestMsgCtx(ctx, msg)
+}
+
+// RequestMsgCtx 请求直到收到应答或ctx结束，ctx没有截止时间时使用nats.DefaultTimeout
+func (bus *MemoryBus) RequestMsgCtx(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nats.DefaultTimeout)
+		defer cancel()
+	}
+	inbox := nats.NewInbox()
+	replies := make(chan *nats.Msg, 1)
+	sub, err := bus.subscribe(inbox, "", func(_ context.Context, reply *nats.Msg) {
+		select {
+		case replies <- reply:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer bus.unsubscribe(sub)
+	// 处理器可以在返回后再应答，登记保留到请求结束
+	bus.trackReply(inbox)
+	defer bus.forgetReply(inbox)
+
+	req := copyMsg(msg)
+	req.Reply = inbox
+	n, err := bus.publish(req, false)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nats.ErrNoResponders
+	}
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (bus *MemoryBus) RequestJsonCtx(ctx context.Context, subject string, v any, vPtr any) error {
+	return bus.RequestEncodedCtx(ctx, subject, v, vPtr, JsonCodec{})
+}
+
+func (bus *MemoryBus) RequestEncodedCtx(ctx context.Context, subject string, v any, vPtr any, codec ...Codec) error {
+	return requestEncoded(ctx, bus, bus.pickCodec(codec), subject, v, vPtr)
+}
+
+func (bus *MemoryBus) AddNatsHandler(subject string, handler nats.MsgHandler) error {
+	return bus.AddNatsCtxHandler(subject, func(_ context.Context, msg *nats.Msg) {
+		handler(msg)
+	})
+}
+
+func (bus *MemoryBus) AddNatsCtxHandler(subject string, handler MsgHandler) error {
+	return bus.AddNatsQueueHandler(subject, "", handler)
+}
+
+// AddNatsQueueHandler 添加队列组处理器，同一队列组中每条消息只由一个处理器处理
+func (bus *MemoryBus) AddNatsQueueHandler(subject string, queue string, handler MsgHandler) error {
+	_, err := bus.subscribe(subject, queue, bus.applyMiddlewares(handler))
+	return err
+}
+
+func (bus *MemoryBus) AddNatsJSONHandler(subject string, handler nats.Handler) error {
+	return bus.AddNatsEncodedHandler(subject, handler, JsonCodec{})
+}
+
+// AddNatsEncodedHandler 添加自动解码的消息处理器，支持的签名与NatsHelper.AddNatsEncodedHandler相同
+func (bus *MemoryBus) AddNatsEncodedHandler(subject string, handler nats.Handler, codec ...Codec) error {
+	cb, err := encodedHandler(handler, bus.pickCodec(codec))
+	if err != nil {
+		return err
+	}
+	return bus.AddNatsCtxHandler(subject, cb)
+}
+
+func (bus *MemoryBus) applyMiddlewares(handler MsgHandler) MsgHandler {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	for i := len(bus.middlewares) - 1; i >= 0; i-- {
+		handler = bus.middlewares[i](handler)
+	}
+	return handler
+}
+
+func (bus *MemoryBus) subscribe(subject string, queue string, handler MsgHandler) (*memorySub, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, nats.ErrBadSubject
+	}
+	sub := &memorySub{
+		subject: subject,
+		queue:   queue,
+		handler: handler,
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if bus.closed {
+		return nil, nats.ErrConnectionClosed
+	}
+	bus.subs = append(bus.subs, sub)
+	go sub.run(bus)
+	return sub, nil
+}
+
+func (bus *MemoryBus) unsubscribe(sub *memorySub) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if i := slices.Index(bus.subs, sub); i >= 0 {
+		bus.subs = slices.Delete(bus.subs, i, i+1)
+		sub.stop(bus)
+	}
+}
+
+// push 加入待处理队列，订阅已取消时返回false
+func (sub *memorySub) push(msg memoryMsg) bool {
+	sub.lock.Lock()
+	if sub.closed {
+		sub.lock.Unlock()
+		return false
+	}
+	sub.msgs = append(sub.msgs, msg)
+	sub.lock.Unlock()
+	select {
+	case sub.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (sub *memorySub) stop(bus *MemoryBus) {
+	sub.lock.Lock()
+	dropped := sub.msgs
+	sub.msgs, sub.closed = nil, true
+	sub.lock.Unlock()
+	close(sub.done)
+	for _, m := range dropped {
+		m.delivery.done()
+	}
+	bus.addPending(-len(dropped))
+}
+
+func (sub *memorySub) run(bus *MemoryBus) {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-sub.signal:
+		}
+		for {
+			sub.lock.Lock()
+			if len(sub.msgs) == 0 {
+				sub.lock.Unlock()
+				break
+			}
+			m := sub.msgs[0]
+			sub.msgs = sub.msgs[1:]
+			sub.lock.Unlock()
+			sub.handle(m.msg)
+			m.delivery.done()
+			bus.addPending(-1)
+		}
+	}
+}
+
+func (sub *memorySub) handle(msg *nats.Msg) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("memory bus handler for %s panic: %v", msg.Subject, r)
+		}
+	}()
+	sub.handler(context.Background(), msg)
+}
@@ -0,0 +1,73 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+func TestMemoryBusReplies(t *testing.T) {
+	bus := NewMemoryBus()
+	ctx := context.Background()
+	_ = bus.AddNatsCtxHandler("test.echo", func(ctx context.Context, msg *nats.Msg) {
+		_ = Respond(msg, msg.Data)
+	})
+	_ = bus.AddNatsCtxHandler("test.ignore", func(ctx context.Context, msg *nats.Msg) {})
+	replies := make(chan *nats.Msg, 1)
+	_ = bus.AddNatsCtxHandler("test.inbox.*", func(ctx context.Context, msg *nats.Msg) {
+		replies <- msg
+	})
+	registered := func(reply string) bool {
+		_, ok := memoryReplies.Load(reply)
+		return ok
+	}
+
+	// 直接发送带应答主题的消息，应答后移除登记
+	msg := nats.NewMsg("test.echo")
+	msg.Reply, msg.Data = "test.inbox.1", []byte("hi")
+	if err := bus.PublishMsgCtx(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	bus.Flush()
+	if reply := <-replies; string(reply.Data) != "hi" {
+		t.Fatalf("unexpected reply: %s", reply.Data)
+	}
+	if registered("test.inbox.1") {
+		t.Fatal("reply subject should be removed after reply")
+	}
+
+	if _, err := bus.RequestCtx(ctx, "test.echo", []byte("req")); err != nil {
+		t.Fatal(err)
+	}
+	// 没有应答的消息在处理完成后移除
+	msg = nats.NewMsg("test.ignore")
+	msg.Reply = "test.inbox.2"
+	if err := bus.PublishMsgCtx(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	bus.Flush()
+	if registered("test.inbox.2") || len(bus.replies) != 0 {
+		t.Fatalf("reply subject should be removed after handling: %v", bus.replies)
+	}
+
+	// 处理中的消息在总线关闭时移除
+	handling, release := make(chan struct{}), make(chan struct{})
+	_ = bus.AddNatsCtxHandler("test.block", func(ctx context.Context, msg *nats.Msg) {
+		close(handling)
+		<-release
+	})
+	defer close(release)
+	msg = nats.NewMsg("test.block")
+	msg.Reply = "test.inbox.3"
+	if err := bus.PublishMsgCtx(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	<-handling
+	if !registered("test.inbox.3") {
+		t.Fatal("reply subject should be registered while handling")
+	}
+	bus.Close()
+	if registered("test.inbox.3") || len(bus.replies) != 0 {
+		t.Fatal("reply subjects should be removed on close")
+	}
+}
@@ -0,0 +1,106 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type greeting struct {
+	Name string `json:"name"`
+}
+
+// greet 只依赖natsx.Bus的业务代码
+func greet(ctx context.Context, bus natsx.Bus, name string) (string, error) {
+	reply, err := natsx.RequestAs[greeting](ctx, bus, "test.greet", &greeting{Name: name})
+	if err != nil {
+		return "", err
+	}
+	return reply.Name, bus.PublishEncodedCtx(ctx, "test.greeted."+name, reply)
+}
+
+func TestMemoryBus(t *testing.T) {
+	bus := natsx.NewMemoryBus()
+	t.Cleanup(bus.Close)
+	bus.Use(natsx.Recover())
+
+	err := bus.AddNatsJSONHandler("test.greet", func(ctx context.Context, subject, reply string, g *greeting) {
+		if g.Name == "" {
+			_ = natsx.RespondError(&nats.Msg{Subject: subject, Reply: reply}, http.StatusBadRequest, "name required")
+			return
+		}
+		_ = bus.PublishEncodedCtx(ctx, reply, &greeting{Name: "hello " + g.Name})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var greeted []string
+	err = bus.AddNatsHandler("test.greeted.*", func(msg *nats.Msg) {
+		lock.Lock()
+		defer lock.Unlock()
+		greeted = append(greeted, msg.Subject)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queued [2]int
+	for i := range queued {
+		i := i
+		err := bus.AddNatsQueueHandler("test.greeted.>", "workers", func(ctx context.Context, msg *nats.Msg) {
+			lock.Lock()
+			defer lock.Unlock()
+			queued[i]++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, name := range []string{"alice", "bob"} {
+		reply, err := greet(ctx, bus, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != "hello "+name {
+			t.Fatalf("unexpected reply %s", reply)
+		}
+	}
+	bus.Flush()
+	lock.Lock()
+	if len(greeted) != 2 || greeted[0] != "test.greeted.alice" || queued[0]+queued[1] != 2 || queued[0] != 1 {
+		t.Fatalf("unexpected deliveries: %v %v", greeted, queued)
+	}
+	lock.Unlock()
+
+	var serviceErr *natsx.ServiceErr
+	if _, err := greet(ctx, bus, ""); !errors.As(err, &serviceErr) || serviceErr.Code != http.StatusBadRequest {
+		t.Fatalf("expect service error, got %v", err)
+	}
+	if _, err := bus.RequestCtx(ctx, "test.nobody", nil); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expect no responders, got %v", err)
+	}
+
+	// 处理器中的panic由中间件恢复并应答500
+	if err := bus.AddNatsCtxHandler("test.panic", func(ctx context.Context, msg *nats.Msg) {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bus.RequestCtx(ctx, "test.panic", nil)
+	if err != nil || !errors.As(natsx.ServiceError(reply), &serviceErr) || serviceErr.Code != http.StatusInternalServerError {
+		t.Fatalf("expect recovered error reply, got %v, %v", reply, err)
+	}
+
+	bus.Close()
+	if err := bus.PublishCtx(ctx, "test.greeted.x", nil); !errors.Is(err, nats.ErrConnectionClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"k8s.io/klog/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+const meterName = "github.com/TiyaAnlite/FocotServicesCommon/natsx"
+
+// NatsStatus 连接状态快照，可直接用于健康检查接口
+type NatsStatus struct {
+	Connected     bool                 `json:"connected"`
+	Status        string               `json:"status"`
+	ConnectedUrl  string               `json:"connected_url,omitempty"`
+	ServerId      string               `json:"server_id,omitempty"`
+	LastError     string               `json:"last_error,omitempty"`
+	Reconnects    uint64               `json:"reconnects"`
+	InMsgs        uint64               `json:"in_msgs"`
+	OutMsgs       uint64               `json:"out_msgs"`
+	InBytes       uint64               `json:"in_bytes"`
+	OutBytes      uint64               `json:"out_bytes"`
+	RTT           time.Duration        `json:"rtt,omitempty"`
+	Subscriptions []SubscriptionStatus `json:"subscriptions"`
+	Spool         *SpoolStatus         `json:"spool,omitempty"`
+}
+
+// SubscriptionStatus 单个订阅的积压与丢弃情况
+type SubscriptionStatus struct {
+	Subject      string `json:"subject"`
+	Queue        string `json:"queue,omitempty"`
+	Valid        bool   `json:"valid"`
+	PendingMsgs  int    `json:"pending_msgs"`
+	PendingBytes int    `json:"pending_bytes"`
+	Dropped      int    `json:"dropped"`
+}
+
+// Status 获取当前连接状态
+func (helper *NatsHelper) Status() NatsStatus {
+	status := NatsStatus{Status: nats.CLOSED.String()}
+	if helper.Nc == nil {
+		return status
+	}
+	stats := helper.Nc.Stats()
+	status.Connected = helper.Nc.IsConnected()
+	status.Status = helper.Nc.Status().String()
+	status.Reconnects = stats.Reconnects
+	status.InMsgs, status.OutMsgs = stats.InMsgs, stats.OutMsgs
+	status.InBytes, status.OutBytes = stats.InBytes, stats.OutBytes
+	if err := helper.Nc.LastError(); err != nil {
+		status.LastError = err.Error()
+	}
+	if status.Connected {
+		status.ConnectedUrl = helper.Nc.ConnectedUrlRedacted()
+		status.ServerId = helper.Nc.ConnectedServerId()
+		if rtt, err := helper.Nc.RTT(); err == nil {
+			status.RTT = rtt
+		}
+	}
+	for _, sub := range helper.subscriptions() {
+		status.Subscriptions = append(status.Subscriptions, subscriptionStatus(sub))
+	}
+	if helper.spool != nil {
+		spool := helper.spool.Status()
+		status.Spool = &spool
+	}
+	return status
+}
+
+func subscriptionStatus(sub *nats.Subscription) SubscriptionStatus {
+	s := SubscriptionStatus{Subject: sub.Subject, Queue: sub.Queue, Valid: sub.IsValid()}
+	if !s.Valid {
+		return s
+	}
+	s.PendingMsgs, s.PendingBytes, _ = sub.Pending()
+	s.Dropped, _ = sub.Dropped()
+	return s
+}
+
+type natsMetrics struct {
+	disconnects  metric.Int64Counter
+	asyncErrors  metric.Int64Counter
+	registration metric.Registration
+}
+
+func (m *natsMetrics) recordDisconnect() {
+	if m != nil {
+		m.disconnects.Add(context.Background(), 1)
+	}
+}
+
+func (m *natsMetrics) recordError(sub *nats.Subscription, err error) {
+	if m == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.String("error", errorClass(err))}
+	if sub != nil {
+		attrs = append(attrs, attribute.String("subject", sub.Subject), attribute.String("queue", sub.Queue))
+	}
+	m.asyncErrors.Add(context.Background(), 1, metric.WithAttributes(attrs...))
+}
+
+// errorClass 将错误归类为有限的取值，避免错误消息作为指标属性导致基数无限增长
+func errorClass(err error) string {
+	var schemaErr *SchemaError
+	switch {
+	case errors.Is(err, nats.ErrSlowConsumer):
+		return "slow_consumer"
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, nats.ErrNoResponders):
+		return "no_responders"
+	case errors.Is(err, nats.ErrMaxPayload):
+		return "max_payload"
+	case errors.Is(err, nats.ErrAuthorization), errors.Is(err, nats.ErrAuthExpired), errors.Is(err, nats.ErrAuthRevoked),
+		errors.Is(err, nats.ErrAccountAuthExpired), strings.Contains(err.Error(), "permissions violation"):
+		return "permission"
+	case errors.Is(err, ErrCodecNotFound), errors.Is(err, ErrInvalidProtobuf), errors.Is(err, ErrInvalidRaw):
+		return "codec"
+	case errors.As(err, &schemaErr):
+		return "schema"
+	case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrDisconnected), errors.Is(err, nats.ErrStaleConnection):
+		return "connection"
+	}
+	return "other"
+}
+
+func (m *natsMetrics) unregister() {
+	if m != nil && m.registration != nil {
+		if err := m.registration.Unregister(); err != nil {
+			klog.Errorf("failed to unregister nats metrics: %v", err)
+		}
+	}
+}
+
+// setupMetrics 注册连接nc与订阅的指标，数据在采集时从连接实时读取
+func (helper *NatsHelper) setupMetrics(nc *nats.Conn) (*natsMetrics, error) {
+	meter := otel.Meter(meterName)
+	m := &natsMetrics{}
+	var err error
+	if m.disconnects, err = meter.Int64Counter("nats.client.disconnects",
+		metric.WithDescription("Number of disconnects from the nats server")); err != nil {
+		return nil, err
+	}
+	if m.asyncErrors, err = meter.Int64Counter("nats.client.errors",
+		metric.WithDescription("Number of asynchronous errors, e.g. slow consumers")); err != nil {
+		return nil, err
+	}
+	connected, err := meter.Int64ObservableGauge("nats.client.connected",
+		metric.WithDescription("1 if connected to the nats server, otherwise 0"))
+	if err != nil {
+		return nil, err
+	}
+	reconnects, err := meter.Int64ObservableCounter("nats.client.reconnects",
+		metric.WithDescription("Number of reconnects to the nats server"))
+	if err != nil {
+		return nil, err
+	}
+	inMsgs, err := meter.Int64ObservableCounter("nats.client.messages.in",
+		metric.WithDescription("Number of messages received"))
+	if err != nil {
+		return nil, err
+	}
+	outMsgs, err := meter.Int64ObservableCounter("nats.client.messages.out",
+		metric.WithDescription("Number of messages sent"))
+	if err != nil {
+		return nil, err
+	}
+	inBytes, err := meter.Int64ObservableCounter("nats.client.bytes.in",
+		metric.WithDescription("Number of bytes received"), metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	outBytes, err := meter.Int64ObservableCounter("nats.client.bytes.out",
+		metric.WithDescription("Number of bytes sent"), metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	pendingMsgs, err := meter.Int64ObservableGauge("nats.client.subscription.pending.messages",
+		metric.WithDescription("Number of messages pending delivery to a subscription handler"))
+	if err != nil {
+		return nil, err
+	}
+	pendingBytes, err := meter.Int64ObservableGauge("nats.client.subscription.pending.bytes",
+		metric.WithDescription("Number of bytes pending delivery to a subscription handler"), metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := meter.Int64ObservableCounter("nats.client.subscription.dropped",
+		metric.WithDescription("Number of messages dropped by a subscription as a slow consumer"))
+	if err != nil {
+		return nil, err
+	}
+	spoolDepth, err := meter.Int64ObservableGauge("nats.client.spool.depth",
+		metric.WithDescription("Number of messages spooled on disk waiting for reconnect"))
+	if err != nil {
+		return nil, err
+	}
+	spoolBytes, err := meter.Int64ObservableGauge("nats.client.spool.bytes",
+		metric.WithDescription("Size of the on-disk publish spool"), metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+	spoolDropped, err := meter.Int64ObservableCounter("nats.client.spool.dropped",
+		metric.WithDescription("Number of messages dropped because the publish spool was full"))
+	if err != nil {
+		return nil, err
+	}
+
+	m.registration, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		var isConnected int64
+		if nc.IsConnected() {
+			isConnected = 1
+		}
+		o.ObserveInt64(connected, isConnected)
+		stats := nc.Stats()
+		o.ObserveInt64(reconnects, int64(stats.Reconnects))
+		o.ObserveInt64(inMsgs, int64(stats.InMsgs))
+		o.ObserveInt64(outMsgs, int64(stats.OutMsgs))
+		o.ObserveInt64(inBytes, int64(stats.InBytes))
+		o.ObserveInt64(outBytes, int64(stats.OutBytes))
+		for _, sub := range helper.subscriptions() {
+			s := subscriptionStatus(sub)
+			if !s.Valid {
+				continue
+			}
+			attrs := metric.WithAttributes(attribute.String("subject", s.Subject), attribute.String("queue", s.Queue))
+			o.ObserveInt64(pendingMsgs, int64(s.PendingMsgs), attrs)
+			o.ObserveInt64(pendingBytes, int64(s.PendingBytes), attrs)
+			o.ObserveInt64(dropped, int64(s.Dropped), attrs)
+		}
+		if helper.spool != nil {
+			s := helper.spool.Status()
+			o.ObserveInt64(spoolDepth, s.Depth)
+			o.ObserveInt64(spoolBytes, s.Bytes)
+			o.ObserveInt64(spoolDropped, s.Dropped)
+		}
+		return nil
+	}, connected, reconnects, inMsgs, outMsgs, inBytes, outBytes, pendingMsgs, pendingBytes, dropped,
+		spoolDepth, spoolBytes, spoolDropped)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,220 @@
+package natsx
+
+import (
+	"context"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const (
+	// HeaderServiceError 处理失败时应答中携带的错误信息，与NATS服务API一致
+	HeaderServiceError     = "Nats-Service-Error"
+	HeaderServiceErrorCode = "Nats-Service-Error-Code"
+)
+
+// MsgHandler 带上下文的消息处理器
+type MsgHandler func(ctx context.Context, msg *nats.Msg)
+
+// Middleware 消息处理中间件，通过NatsHelper.Use注册
+type Middleware func(next MsgHandler) MsgHandler
+
+// Use 添加中间件，先添加的在外层
+// 只对之后注册的处理器生效，应在AddNatsHandler等调用之前使用
+func (helper *NatsHelper) Use(middleware ...Middleware) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.middlewares = append(helper.middlewares, middleware...)
+}
+
+func (helper *NatsHelper) applyMiddlewares(handler MsgHandler) MsgHandler {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	for i := len(helper.middlewares) - 1; i >= 0; i-- {
+		handler = helper.middlewares[i](handler)
+	}
+	return handler
+}
+
+// RespondError 以NATS服务API的错误头应答请求，非请求消息时忽略
+func RespondError(msg *nats.Msg, code int, description string) error {
+	if msg.Reply == "" {
+		return nil
+	}
+	reply := nats.NewMsg(msg.Reply)
+	reply.Header.Set(HeaderServiceError, description)
+	reply.Header.Set(HeaderServiceErrorCode, strconv.Itoa(code))
+	return RespondMsg(msg, reply)
+}
+
+// ServiceError 读取应答中的错误头，没有错误时返回nil
+func ServiceError(msg *nats.Msg) error {
+	description := msg.Header.Get(HeaderServiceError)
+	if description == "" {
+		return nil
+	}
+	code, _ := strconv.Atoi(msg.Header.Get(HeaderServiceErrorCode))
+	return &ServiceErr{Code: code, Description: description}
+}
+
+// ServiceErr 对端处理失败返回的错误
+type ServiceErr struct {
+	Code        int
+	Description string
+}
+
+func (e *ServiceErr) Error() string {
+	return fmt.Sprintf("nats service error %d: %s", e.Code, e.Description)
+}
+
+// Recover 提供对崩溃的处理，请求消息会收到500错误应答
+func Recover() Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			defer func() {
+				if r := recover(); r != nil {
+					err, ok := r.(error)
+					if !ok {
+						err = fmt.Errorf("%v", r)
+					}
+					stack := make([]byte, 4<<10) // default stack length: 4kb
+					length := runtime.Stack(stack, false)
+					klog.Errorf("[PANIC RECOVER] %s: %v\n%s", msg.Subject, err, stack[:length])
+					if span := trace.SpanFromContext(ctx); span.IsRecording() {
+						utils.ErrorWithCtx(ctx, fmt.Sprintf("[PANIC RECOVER] %s", err.Error()))
+					}
+					_ = RespondError(msg, http.StatusInternalServerError, "Internal Server Error")
+				}
+			}()
+			next(ctx, msg)
+		}
+	}
+}
+
+// Logger 记录每条消息的主题、大小与处理耗时
+func Logger() Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			start := time.Now()
+			next(ctx, msg)
+			klog.InfoS("nats message handled",
+				"subject", msg.Subject,
+				"reply", msg.Reply,
+				"size", len(msg.Data),
+				"latency", time.Since(start).String(),
+			)
+		}
+	}
+}
+
+// Tracing 从消息头中提取追踪上下文并创建消费者Span
+func Tracing() Middleware {
+	tracer := otel.Tracer(meterName)
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier(msg.Header))
+			ctx, span := tracer.Start(ctx, "nats "+subscriptionSubject(msg),
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(
+					attribute.String("messaging.system", "nats"),
+					attribute.String("messaging.destination.name", msg.Subject),
+					attribute.Int("messaging.message.body.size", len(msg.Data)),
+				))
+			defer func() {
+				if r := recover(); r != nil {
+					span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", r))
+					span.End()
+					panic(r)
+				}
+				span.End()
+			}()
+			next(ctx, msg)
+		}
+	}
+}
+
+// Timeout 为每条消息的处理设置超时，处理器需自行检查ctx
+func Timeout(timeout time.Duration) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			next(ctx, msg)
+			if ctx.Err() == context.DeadlineExceeded {
+				utils.WarningWithCtx(ctx, fmt.Sprintf("nats handler for %s exceeded timeout %s", msg.Subject, timeout))
+			}
+		}
+	}
+}
+
+// Metrics 记录每个订阅的消息数与处理耗时
+func Metrics() Middleware {
+	meter := otel.Meter(meterName)
+	duration, err := meter.Float64Histogram("nats.handler.duration",
+		metric.WithDescription("Time spent handling a message"), metric.WithUnit("ms"))
+	if err != nil {
+		klog.Errorf("failed to setup nats handler metrics: %v", err)
+	}
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			start := time.Now()
+			status := "ok"
+			defer func() {
+				r := recover()
+				if r != nil {
+					status = "panic"
+				}
+				if duration != nil {
+					duration.Record(ctx, float64(time.Since(start).Microseconds())/1000, metric.WithAttributes(
+						attribute.String("subject", subscriptionSubject(msg)),
+						attribute.String("status", status),
+					))
+				}
+				if r != nil {
+					panic(r)
+				}
+			}()
+			next(ctx, msg)
+		}
+	}
+}
+
+// subscriptionSubject 使用订阅的主题(可能含通配符)以控制指标与Span名的基数
+func subscriptionSubject(msg *nats.Msg) string {
+	if msg.Sub != nil {
+		return msg.Sub.Subject
+	}
+	return msg.Subject
+}
+
+// HeaderCarrier 让消息头可用于otel的上下文传播
+type HeaderCarrier nats.Header
+
+var _ propagation.TextMapCarrier = HeaderCarrier(nil)
+
+func (c HeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c HeaderCarrier) Set(key string, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
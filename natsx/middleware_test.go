@@ -0,0 +1,53 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	helper := &NatsHelper{}
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next MsgHandler) MsgHandler {
+			return func(ctx context.Context, msg *nats.Msg) {
+				order = append(order, name)
+				next(ctx, msg)
+			}
+		}
+	}
+	helper.Use(Recover(), trace("first"), trace("second"), Timeout(time.Second))
+	var deadline bool
+	handler := helper.wrapHandler(func(ctx context.Context, msg *nats.Msg) {
+		_, deadline = ctx.Deadline()
+		panic("handler panic")
+	})
+	handler(&nats.Msg{Subject: "test.middleware"})
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("unexpected middleware order: %v", order)
+	}
+	if !deadline {
+		t.Fatal("timeout middleware should set deadline")
+	}
+}
+
+func TestEncodedHandler(t *testing.T) {
+	msg, err := EncodeMsg(JsonCodec{}, "test.encoded", &codecTestData{Key: "k", Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *codecTestData
+	var gotSubject string
+	handler, err := encodedHandler(func(ctx context.Context, subject string, v *codecTestData) {
+		gotSubject, got = subject, v
+	}, JsonCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler(context.Background(), msg)
+	if gotSubject != "test.encoded" || got == nil || got.Key != "k" {
+		t.Fatalf("unexpected handler result: %s %+v", gotSubject, got)
+	}
+}
@@ -1,56 +1,178 @@
 package natsx
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
 	"github.com/nats-io/nats.go"
 	"k8s.io/klog/v2"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type NatsConfig struct {
-	NatsUrl  string `json:"nats_url" yaml:"nats_url" env:"NATS_URL" envDefault:"127.0.0.1"`
-	NatsName string `json:"nats_name" yaml:"nats_name" env:"NATS_NAME"`
-	NatsNkey string `json:"nats_nkey" yaml:"nats_nkey" env:"NATS_NKEY"`
+	NatsUrl     string   `json:"nats_url" yaml:"nats_url" env:"NATS_URL" envDefault:"127.0.0.1"`
+	NatsServers []string `json:"nats_servers" yaml:"nats_servers" env:"NATS_SERVERS" envSeparator:","`
+	NatsName    string   `json:"nats_name" yaml:"nats_name" env:"NATS_NAME"`
+	NatsNkey    string   `json:"nats_nkey" yaml:"nats_nkey" env:"NATS_NKEY"`
+	NatsCreds   string   `json:"nats_creds" yaml:"nats_creds" env:"NATS_CREDS"`
+	NatsUser    string   `json:"nats_user" yaml:"nats_user" env:"NATS_USER"`
+	NatsPass    string   `json:"nats_pass" yaml:"nats_pass" env:"NATS_PASS"`
+	NatsToken   string   `json:"nats_token" yaml:"nats_token" env:"NATS_TOKEN"`
+	// TLS，设置任意一项即启用
+	NatsTLS         bool   `json:"nats_tls" yaml:"nats_tls" env:"NATS_TLS"`
+	NatsTLSCa       string `json:"nats_tls_ca" yaml:"nats_tls_ca" env:"NATS_TLS_CA"`
+	NatsTLSCert     string `json:"nats_tls_cert" yaml:"nats_tls_cert" env:"NATS_TLS_CERT"`
+	NatsTLSKey      string `json:"nats_tls_key" yaml:"nats_tls_key" env:"NATS_TLS_KEY"`
+	NatsTLSInsecure bool   `json:"nats_tls_insecure" yaml:"nats_tls_insecure" env:"NATS_TLS_INSECURE"`
+	// 连接调优，零值时使用nats默认值
+	NatsTimeout         time.Duration `json:"nats_timeout" yaml:"nats_timeout" env:"NATS_TIMEOUT"`
+	NatsReconnectWait   time.Duration `json:"nats_reconnect_wait" yaml:"nats_reconnect_wait" env:"NATS_RECONNECT_WAIT"`
+	NatsReconnectJitter time.Duration `json:"nats_reconnect_jitter" yaml:"nats_reconnect_jitter" env:"NATS_RECONNECT_JITTER"`
+	NatsReconnectBuf    int           `json:"nats_reconnect_buf" yaml:"nats_reconnect_buf" env:"NATS_RECONNECT_BUF"`
+	NatsPingInterval    time.Duration `json:"nats_ping_interval" yaml:"nats_ping_interval" env:"NATS_PING_INTERVAL"`
+	NatsMaxPingsOut     int           `json:"nats_max_pings_out" yaml:"nats_max_pings_out" env:"NATS_MAX_PINGS_OUT"`
+	NatsNoRandomize     bool          `json:"nats_no_randomize" yaml:"nats_no_randomize" env:"NATS_NO_RANDOMIZE"`
+	NatsTelemetry       bool          `json:"nats_telemetry" yaml:"nats_telemetry" env:"NATS_TELEMETRY" envDefault:"true"`
+	// 断线期间的本地暂存，设置目录即启用
+	NatsSpoolDir      string `json:"nats_spool_dir" yaml:"nats_spool_dir" env:"NATS_SPOOL_DIR"`
+	NatsSpoolMaxBytes int64  `json:"nats_spool_max_bytes" yaml:"nats_spool_max_bytes" env:"NATS_SPOOL_MAX_BYTES"`
 }
 
-type NatsHelper struct {
-	Nc   *nats.Conn
-	Ec   *nats.EncodedConn
-	Js   nats.JetStreamContext
-	subs []*nats.Subscription
-
-	// 普通消息发送
-	Publish     func(subject string, data []byte) error
-	PublishJson func(subject string, v interface{}) error
-	// 请求应答
-	Request     func(subj string, data []byte, timeout time.Duration) (*nats.Msg, error)
-	RequestJson func(subject string, v interface{}, vPtr interface{}, timeout time.Duration) error
+// ServerUrl 合并NatsUrl与NatsServers为nats.Connect使用的地址列表，去除空项与重复项
+func (cfg *NatsConfig) ServerUrl() string {
+	servers := make([]string, 0, len(cfg.NatsServers)+1)
+	for _, server := range append([]string{cfg.NatsUrl}, cfg.NatsServers...) {
+		if server = strings.TrimSpace(server); server != "" && !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nats.DefaultURL
+	}
+	return strings.Join(servers, ",")
 }
 
-func (helper *NatsHelper) Open(cfg NatsConfig) error {
-	klog.V(1).Infof("connecting to nats: %s", cfg.NatsUrl)
+// Options 根据配置生成连接选项，不包含NatsHelper自身的回调
+func (cfg *NatsConfig) Options() ([]nats.Option, error) {
 	var opts []nats.Option
 	if cfg.NatsName != "" {
 		opts = append(opts, nats.Name(cfg.NatsName))
 	}
+	// 认证
 	if cfg.NatsNkey != "" {
 		nkey, err := nats.NkeyOptionFromSeed(cfg.NatsNkey)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		opts = append(opts, nkey)
 	}
+	if cfg.NatsCreds != "" {
+		opts = append(opts, nats.UserCredentials(cfg.NatsCreds))
+	}
+	if cfg.NatsUser != "" {
+		opts = append(opts, nats.UserInfo(cfg.NatsUser, cfg.NatsPass))
+	}
+	if cfg.NatsToken != "" {
+		opts = append(opts, nats.Token(cfg.NatsToken))
+	}
+	// TLS
+	if cfg.NatsTLS || cfg.NatsTLSCa != "" || cfg.NatsTLSCert != "" || cfg.NatsTLSInsecure {
+		opts = append(opts, nats.Secure(&tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.NatsTLSInsecure,
+		}))
+	}
+	if cfg.NatsTLSCa != "" {
+		opts = append(opts, nats.RootCAs(cfg.NatsTLSCa))
+	}
+	if cfg.NatsTLSCert != "" || cfg.NatsTLSKey != "" {
+		if cfg.NatsTLSCert == "" || cfg.NatsTLSKey == "" {
+			return nil, errors.New("natsx: both NATS_TLS_CERT and NATS_TLS_KEY are required")
+		}
+		opts = append(opts, nats.ClientCert(cfg.NatsTLSCert, cfg.NatsTLSKey))
+	}
+	// 连接调优
+	if cfg.NatsTimeout > 0 {
+		opts = append(opts, nats.Timeout(cfg.NatsTimeout))
+	}
+	if cfg.NatsReconnectWait > 0 {
+		opts = append(opts, nats.ReconnectWait(cfg.NatsReconnectWait))
+	}
+	if cfg.NatsReconnectJitter > 0 {
+		opts = append(opts, nats.ReconnectJitter(cfg.NatsReconnectJitter, cfg.NatsReconnectJitter))
+	}
+	if cfg.NatsReconnectBuf != 0 {
+		opts = append(opts, nats.ReconnectBufSize(cfg.NatsReconnectBuf))
+	}
+	if cfg.NatsPingInterval > 0 {
+		opts = append(opts, nats.PingInterval(cfg.NatsPingInterval))
+	}
+	if cfg.NatsMaxPingsOut > 0 {
+		opts = append(opts, nats.MaxPingsOutstanding(cfg.NatsMaxPingsOut))
+	}
+	if cfg.NatsNoRandomize {
+		opts = append(opts, nats.DontRandomize())
+	}
+	return opts, nil
+}
+
+type NatsHelper struct {
+	Nc      *nats.Conn
+	Js      nats.JetStreamContext
+	subs    []*nats.Subscription
+	lock    sync.RWMutex
+	closers []func()
+	codec   Codec
+	metrics atomic.Pointer[natsMetrics]
+
+	middlewares []Middleware
+	schemas     []subjectSchema
+	retryPolicy *RetryPolicy
+
+	claimCheck   *ClaimCheck
+	objectStores sync.Map
+	spool        *Spool
+
+	// 普通消息发送
+	Publish     func(subject string, data []byte) error
+	PublishJson func(subject string, v interface{}) error
+	// 请求应答
+	Request     func(subj string, data []byte, timeout time.Duration) (*nats.Msg, error)
+	RequestJson func(subject string, v interface{}, vPtr interface{}, timeout time.Duration) error
+}
+
+func (helper *NatsHelper) Open(cfg NatsConfig) error {
+	url := cfg.ServerUrl()
+	klog.V(1).Infof("connecting to nats: %s", url)
+	opts, err := cfg.Options()
+	if err != nil {
+		return err
+	}
 	opts = append(opts,
 		nats.NoEcho(),
 		nats.MaxReconnects(-1),
 		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			helper.metrics.Load().recordDisconnect()
 			if err != nil {
 				klog.Errorf("nats disconnect: %v", err.Error())
 			}
 		}),
 		nats.ReconnectHandler(func(c *nats.Conn) {
 			klog.Infof("nats reconnected: %s", c.ConnectedUrl())
+			if helper.spool != nil {
+				go helper.spool.replay()
+			}
 		}),
 		nats.ErrorHandler(func(c *nats.Conn, s *nats.Subscription, err error) {
+			helper.metrics.Load().recordError(s, err)
 			if s != nil {
 				klog.Errorf("nats error in %q/%q: %v", s.Subject, s.Queue, err)
 			} else {
@@ -59,24 +181,44 @@ func (helper *NatsHelper) Open(cfg NatsConfig) error {
 		}),
 	)
 
-	var err error
-	helper.Nc, err = nats.Connect(cfg.NatsUrl, opts...)
+	nc, err := nats.Connect(url, opts...)
 	if err != nil {
 		return err
 	}
+	helper.Nc = nc
+	// 连接成功后再注册指标，连接失败时不会遗留注册
+	if cfg.NatsTelemetry {
+		klog.Info("NatsHelper telemetry on")
+		metrics, err := helper.setupMetrics(nc)
+		if err != nil {
+			klog.Errorf("failed to setup telemetry: %s", err.Error())
+		}
+		helper.metrics.Store(metrics)
+	}
+	if cfg.NatsSpoolDir != "" {
+		if err := helper.EnableSpool(cfg.NatsSpoolDir, cfg.NatsSpoolMaxBytes); err != nil {
+			helper.Nc.Close()
+			helper.metrics.Swap(nil).unregister()
+			return fmt.Errorf("failed to enable spool: %w", err)
+		}
+	}
 	return helper.onConnected()
 }
 
 func (helper *NatsHelper) onConnected() error {
-	helper.Publish = helper.Nc.Publish
-	helper.Request = helper.Nc.Request
-	var err error
-	helper.Ec, err = nats.NewEncodedConn(helper.Nc, nats.JSON_ENCODER)
-	if err != nil {
-		return err
+	helper.Publish = func(subject string, data []byte) error {
+		return helper.publishMsg(&nats.Msg{Subject: subject, Data: data})
 	}
-	helper.PublishJson = helper.Ec.Publish
-	helper.RequestJson = helper.Ec.Request
+	helper.Request = func(subj string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+		return helper.requestMsg(&nats.Msg{Subject: subj, Data: data}, timeout)
+	}
+	helper.PublishJson = func(subject string, v interface{}) error {
+		return helper.PublishEncoded(subject, v, JsonCodec{})
+	}
+	helper.RequestJson = func(subject string, v interface{}, vPtr interface{}, timeout time.Duration) error {
+		return helper.RequestEncoded(subject, v, vPtr, timeout, JsonCodec{})
+	}
+	var err error
 	helper.Js, err = helper.Nc.JetStream()
 	if err != nil {
 		return err
@@ -85,7 +227,10 @@ func (helper *NatsHelper) onConnected() error {
 }
 
 func (helper *NatsHelper) Close() {
+	helper.runClosers()
 	helper.unsubscribe()
+	// 连接的回调在Drain期间仍可能读取metrics，原子地取出后再注销
+	helper.metrics.Swap(nil).unregister()
 	if helper.Nc != nil && helper.Nc.IsConnected() {
 		if err := helper.Nc.Drain(); err != nil {
 			klog.Errorf("failed to drain: %v", err)
@@ -97,32 +242,291 @@ func (helper *NatsHelper) Close() {
 // AddNatsHandler 添加消息处理器
 // 相当于调用连接的Subscribe，主要是多了一个自动Unsubscribe
 func (helper *NatsHelper) AddNatsHandler(subject string, handler nats.MsgHandler) error {
-	sub, err := helper.Nc.Subscribe(subject, handler)
+	return helper.subscribe(subject, func(_ context.Context, msg *nats.Msg) {
+		handler(msg)
+	})
+}
+
+// AddNatsCtxHandler 添加带上下文的消息处理器，上下文由中间件提供(追踪、超时等)
+func (helper *NatsHelper) AddNatsCtxHandler(subject string, handler MsgHandler) error {
+	return helper.subscribe(subject, handler)
+}
+
+// AddNatsQueueHandler 添加队列组处理器，同一队列组中每条消息只由一个订阅者处理
+func (helper *NatsHelper) AddNatsQueueHandler(subject string, queue string, handler MsgHandler) error {
+	sub, err := helper.Nc.QueueSubscribe(subject, queue, helper.wrapHandler(handler))
 	if err != nil {
-		klog.Errorf("failed to subscribe to %s: %v", subject, err.Error())
+		klog.Errorf("failed to subscribe to %s in queue %s: %v", subject, queue, err.Error())
 		return err
 	}
-	helper.subs = append(helper.subs, sub)
+	helper.AddSubscribe(sub)
 	return nil
 }
 
-func (helper *NatsHelper) AddNatsJSONHandler(subject string, handler nats.Handler) error {
-	sub, err := helper.Ec.Subscribe(subject, handler)
+// Subscribe 添加经过中间件的处理器并返回订阅，不会在helper.Close时自动取消，需由调用方Unsubscribe
+// 适用于生命周期较短的订阅，如按客户端连接的推送
+func (helper *NatsHelper) Subscribe(subject string, handler MsgHandler) (*nats.Subscription, error) {
+	return helper.Nc.Subscribe(subject, helper.wrapHandler(handler))
+}
+
+func (helper *NatsHelper) subscribe(subject string, handler MsgHandler) error {
+	sub, err := helper.Nc.Subscribe(subject, helper.wrapHandler(handler))
 	if err != nil {
 		klog.Errorf("failed to subscribe to %s: %v", subject, err.Error())
 		return err
 	}
-	helper.subs = append(helper.subs, sub)
+	helper.AddSubscribe(sub)
+	return nil
+}
+
+// wrapHandler 所有经由helper注册的处理器的公共处理，包括中间件与ClaimCheck
+func (helper *NatsHelper) wrapHandler(handler MsgHandler) nats.MsgHandler {
+	chain := helper.applyMiddlewares(func(ctx context.Context, msg *nats.Msg) {
+		if err := helper.prepareIn(ctx, msg); err != nil {
+			_ = RespondError(msg, err.Code, err.Description)
+			if err.Code == http.StatusBadRequest && isJetStreamMsg(msg) {
+				// 重投也无法通过校验，不再投递
+				_ = msg.Term()
+			}
+			return
+		}
+		handler(ctx, msg)
+	})
+	return func(msg *nats.Msg) {
+		chain(context.Background(), msg)
+	}
+}
+
+// prepareIn 调用处理器前取回ClaimCheck消息体并进行schema校验
+func (helper *NatsHelper) prepareIn(ctx context.Context, msg *nats.Msg) *ServiceErr {
+	if IsClaimCheck(msg) {
+		if err := helper.resolveClaimCheck(msg); err != nil {
+			utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to resolve claim check from %s: %v", msg.Subject, err))
+			return &ServiceErr{Code: http.StatusInternalServerError, Description: "failed to resolve claim check"}
+		}
+	}
+	if err := helper.checkSchemaIn(msg); err != nil {
+		utils.WarningWithCtx(ctx, err.Error())
+		return &ServiceErr{Code: http.StatusBadRequest, Description: err.Error()}
+	}
 	return nil
 }
 
+func (helper *NatsHelper) publishMsg(msg *nats.Msg) error {
+	if err := helper.checkSchemaOut(msg); err != nil {
+		return err
+	}
+	spool := helper.spool
+	if spool != nil && msg.Reply == "" {
+		if spooled, err := spool.publish(msg); spooled {
+			return err
+		}
+	}
+	if err := helper.checkOut(msg); err != nil {
+		return err
+	}
+	err := helper.Nc.PublishMsg(msg)
+	if err != nil && spool != nil && msg.Reply == "" {
+		_, err = spool.spoolOnError(msg, err)
+	}
+	return err
+}
+
+// RequestMsg 发送带消息头的请求，与Request一样经过schema校验与ClaimCheck
+func (helper *NatsHelper) RequestMsg(msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	return helper.requestMsg(msg, timeout)
+}
+
+func (helper *NatsHelper) requestMsg(msg *nats.Msg, timeout time.Duration) (*nats.Msg, error) {
+	if err := helper.checkSchemaOut(msg); err != nil {
+		return nil, err
+	}
+	if err := helper.checkOut(msg); err != nil {
+		return nil, err
+	}
+	return helper.Nc.RequestMsg(msg, timeout)
+}
+
+// checkOut 启用ClaimCheck时将超出阈值的消息体转存到对象存储
+func (helper *NatsHelper) checkOut(msg *nats.Msg) error {
+	cc := helper.getClaimCheck()
+	if cc == nil || !cc.oversized(helper, msg) {
+		return nil
+	}
+	return cc.store(msg)
+}
+
+// SetCodec 设置默认编解码器，未设置时为JSON
+func (helper *NatsHelper) SetCodec(codec Codec) {
+	helper.codec = codec
+}
+
+// Codec 当前默认编解码器
+func (helper *NatsHelper) Codec() Codec {
+	if helper.codec == nil {
+		return JsonCodec{}
+	}
+	return helper.codec
+}
+
+func (helper *NatsHelper) pickCodec(codec []Codec) Codec {
+	if len(codec) > 0 && codec[0] != nil {
+		return codec[0]
+	}
+	return helper.Codec()
+}
+
+// PublishEncoded 编码后发送，可单独指定本次使用的编解码器
+func (helper *NatsHelper) PublishEncoded(subject string, v any, codec ...Codec) error {
+	msg, err := EncodeMsg(helper.pickCodec(codec), subject, v)
+	if err != nil {
+		return err
+	}
+	return helper.publishMsg(msg)
+}
+
+// RequestEncoded 编码后请求，应答按其Content-Type解码
+func (helper *NatsHelper) RequestEncoded(subject string, v any, vPtr any, timeout time.Duration, codec ...Codec) error {
+	c := helper.pickCodec(codec)
+	msg, err := EncodeMsg(c, subject, v)
+	if err != nil {
+		return err
+	}
+	reply, err := helper.requestMsg(msg, timeout)
+	if err != nil {
+		return err
+	}
+	if mPtr, ok := vPtr.(*nats.Msg); ok {
+		*mPtr = *reply
+		return nil
+	}
+	return DecodeMsg(reply, vPtr, c)
+}
+
+func (helper *NatsHelper) AddNatsJSONHandler(subject string, handler nats.Handler) error {
+	return helper.AddNatsEncodedHandler(subject, handler, JsonCodec{})
+}
+
+// AddNatsEncodedHandler 添加自动解码的消息处理器
+// handler支持与EncodedConn相同的签名：func(*T)、func(subject string, *T)、func(subject, reply string, *T)、func(*nats.Msg)
+// 也可以在最前面加上context.Context参数，如func(ctx context.Context, subject string, *T)
+func (helper *NatsHelper) AddNatsEncodedHandler(subject string, handler nats.Handler, codec ...Codec) error {
+	cb, err := encodedHandler(handler, helper.pickCodec(codec))
+	if err != nil {
+		return err
+	}
+	return helper.subscribe(subject, cb)
+}
+
+var (
+	emptyMsgType = reflect.TypeOf(&nats.Msg{})
+	contextType  = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+func encodedHandler(handler nats.Handler, codec Codec) (MsgHandler, error) {
+	if handler == nil {
+		return nil, errors.New("natsx: handler required")
+	}
+	cbType := reflect.TypeOf(handler)
+	if cbType.Kind() != reflect.Func {
+		return nil, errors.New("natsx: handler needs to be a func")
+	}
+	numArgs := cbType.NumIn()
+	wantsCtx := numArgs > 0 && cbType.In(0) == contextType
+	if wantsCtx {
+		numArgs--
+	}
+	if numArgs == 0 || numArgs > 3 {
+		return nil, errors.New("natsx: handler requires one to three arguments besides context")
+	}
+	argType := cbType.In(cbType.NumIn() - 1)
+	cbValue := reflect.ValueOf(handler)
+	wantsRaw := argType == emptyMsgType
+
+	return func(ctx context.Context, msg *nats.Msg) {
+		var args []reflect.Value
+		if wantsCtx {
+			args = append(args, reflect.ValueOf(&ctx).Elem())
+		}
+		if wantsRaw {
+			cbValue.Call(append(args, reflect.ValueOf(msg)))
+			return
+		}
+		var oPtr reflect.Value
+		if argType.Kind() != reflect.Ptr {
+			oPtr = reflect.New(argType)
+		} else {
+			oPtr = reflect.New(argType.Elem())
+		}
+		if err := DecodeMsg(msg, oPtr.Interface(), codec); err != nil {
+			utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to decode message from %s: %v", msg.Subject, err))
+			_ = RespondError(msg, http.StatusBadRequest, fmt.Sprintf("failed to decode message: %v", err))
+			return
+		}
+		if argType.Kind() != reflect.Ptr {
+			oPtr = reflect.Indirect(oPtr)
+		}
+		switch numArgs {
+		case 2:
+			args = append(args, reflect.ValueOf(msg.Subject))
+		case 3:
+			args = append(args, reflect.ValueOf(msg.Subject), reflect.ValueOf(msg.Reply))
+		}
+		cbValue.Call(append(args, oPtr))
+	}, nil
+}
+
 // AddSubscribe 添加自定义的订阅主题，主要用于统一Unsubscribe
 func (helper *NatsHelper) AddSubscribe(sub *nats.Subscription) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
 	helper.subs = append(helper.subs, sub)
 }
 
+// AddCloser 注册在Close时调用的清理函数，后注册的先调用，用于扩展包中的后台任务
+func (helper *NatsHelper) AddCloser(closer func()) {
+	helper.addCloser(closer)
+}
+
+// ValidateOut 按注册的schema校验将要发出的消息，供不经由helper发送的扩展包使用
+func (helper *NatsHelper) ValidateOut(msg *nats.Msg) error {
+	return helper.checkSchemaOut(msg)
+}
+
+// ClaimCheckOut 消息超过ClaimCheck阈值时转存消息体，供不经由helper发送的扩展包使用
+func (helper *NatsHelper) ClaimCheckOut(msg *nats.Msg) error {
+	return helper.checkOut(msg)
+}
+
+// addCloser 注册在Close时释放的资源，按注册的逆序执行
+func (helper *NatsHelper) addCloser(closer func()) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.closers = append(helper.closers, closer)
+}
+
+func (helper *NatsHelper) runClosers() {
+	helper.lock.Lock()
+	closers := helper.closers
+	helper.closers = nil
+	helper.lock.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+}
+
+func (helper *NatsHelper) subscriptions() []*nats.Subscription {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	return append([]*nats.Subscription(nil), helper.subs...)
+}
+
 func (helper *NatsHelper) unsubscribe() {
-	for _, sub := range helper.subs {
+	helper.lock.Lock()
+	subs := helper.subs
+	helper.subs = nil
+	helper.lock.Unlock()
+	for _, sub := range subs {
 		if err := sub.Unsubscribe(); err != nil {
 			klog.Errorf("failed to unsubscribe: %v", err)
 		}
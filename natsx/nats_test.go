@@ -1,10 +1,165 @@
-package natsx
+package natsx_test
 
-import "testing"
+import (
+	"context"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"testing"
+	"time"
+)
 
 func TestNATS(t *testing.T) {
-	nats := NatsHelper{}
-	if err := nats.Open(NatsConfig{}); err != nil {
+	helper := natsxtest.New(t)
+	if !helper.Nc.IsConnected() {
+		t.Fatal("nats not connected")
+	}
+	if _, err := helper.Js.AccountInfo(); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestNatsConfigServerUrl(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		url     string
+		servers []string
+		want    string
+	}{
+		{name: "empty", want: nats.DefaultURL},
+		{name: "url only", url: "nats://a:4222", want: "nats://a:4222"},
+		{name: "servers only", servers: []string{"nats://a:4222", " nats://b:4222 ", ""}, want: "nats://a:4222,nats://b:4222"},
+		{name: "merge", url: "nats://a:4222", servers: []string{"nats://b:4222"}, want: "nats://a:4222,nats://b:4222"},
+		{name: "dedup", url: "nats://a:4222", servers: []string{"nats://b:4222", "nats://a:4222", "nats://b:4222"}, want: "nats://a:4222,nats://b:4222"},
+	} {
+		cfg := &natsx.NatsConfig{NatsUrl: c.url, NatsServers: c.servers}
+		if got := cfg.ServerUrl(); got != c.want {
+			t.Errorf("%s: expect %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestNatsConfigOptions(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		cfg   natsx.NatsConfig
+		err   bool
+		check func(opts *nats.Options) bool
+	}{
+		{name: "default", check: func(opts *nats.Options) bool {
+			return opts.Timeout == nats.DefaultTimeout && opts.TLSConfig == nil && !opts.NoRandomize
+		}},
+		{name: "auth", cfg: natsx.NatsConfig{NatsName: "svc", NatsUser: "u", NatsPass: "p", NatsToken: "t"}, check: func(opts *nats.Options) bool {
+			return opts.Name == "svc" && opts.User == "u" && opts.Password == "p" && opts.Token == "t"
+		}},
+		{name: "tuning", cfg: natsx.NatsConfig{
+			NatsTimeout: time.Second, NatsReconnectWait: time.Second * 2, NatsReconnectJitter: time.Millisecond,
+			NatsReconnectBuf: -1, NatsPingInterval: time.Second * 3, NatsMaxPingsOut: 5, NatsNoRandomize: true,
+		}, check: func(opts *nats.Options) bool {
+			return opts.Timeout == time.Second && opts.ReconnectWait == time.Second*2 && opts.ReconnectJitter == time.Millisecond &&
+				opts.ReconnectBufSize == -1 && opts.PingInterval == time.Second*3 && opts.MaxPingsOut == 5 && opts.NoRandomize
+		}},
+		{name: "tls", cfg: natsx.NatsConfig{NatsTLSInsecure: true}, check: func(opts *nats.Options) bool {
+			return opts.Secure && opts.TLSConfig != nil && opts.TLSConfig.InsecureSkipVerify
+		}},
+		{name: "cert without key", cfg: natsx.NatsConfig{NatsTLSCert: "cert.pem"}, err: true},
+		{name: "invalid nkey", cfg: natsx.NatsConfig{NatsNkey: "invalid"}, err: true},
+	} {
+		options, err := c.cfg.Options()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expect error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		opts := nats.GetDefaultOptions()
+		for _, option := range options {
+			if err := option(&opts); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		if !c.check(&opts) {
+			t.Errorf("%s: unexpected options %+v", c.name, opts)
+		}
+	}
+}
+
+func TestStatusMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := otel.GetMeterProvider()
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	defer otel.SetMeterProvider(provider)
+	collect := func() map[string]int64 {
+		var rm metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &rm); err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch data := m.Data.(type) {
+				case metricdata.Gauge[int64]:
+					for _, point := range data.DataPoints {
+						values[m.Name] += point.Value
+					}
+				case metricdata.Sum[int64]:
+					for _, point := range data.DataPoints {
+						values[m.Name] += point.Value
+					}
+				}
+			}
+		}
+		return values
+	}
+
+	s := natsxtest.NewServer(t)
+	// 连接失败时不注册指标
+	failed := &natsx.NatsHelper{}
+	if err := failed.Open(natsx.NatsConfig{NatsUrl: "nats://127.0.0.1:1", NatsTelemetry: true, NatsTimeout: time.Millisecond * 100}); err == nil {
+		t.Fatal("expect connect error")
+	}
+	if values := collect(); len(values) != 0 {
+		t.Fatalf("failed connection should not report metrics: %v", values)
+	}
+
+	cfg := s.Config()
+	cfg.NatsTelemetry = true
+	helper := &natsx.NatsHelper{}
+	if err := helper.Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.AddNatsHandler("test.status", func(msg *nats.Msg) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Publish("test.status", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = helper.Nc.Flush()
+
+	status := helper.Status()
+	if !status.Connected || status.Status != nats.CONNECTED.String() || status.OutMsgs == 0 || status.ServerId == "" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if len(status.Subscriptions) != 1 || status.Subscriptions[0].Subject != "test.status" || !status.Subscriptions[0].Valid {
+		t.Fatalf("unexpected subscriptions: %+v", status.Subscriptions)
+	}
+	values := collect()
+	if values["nats.client.connected"] != 1 || values["nats.client.messages.out"] == 0 || values["nats.client.bytes.out"] < 5 {
+		t.Fatalf("unexpected metrics: %v", values)
+	}
+
+	helper.Close()
+	if status := helper.Status(); status.Connected {
+		t.Fatalf("unexpected status after close: %+v", status)
+	}
+	if values := collect(); values["nats.client.connected"] != 0 {
+		t.Fatalf("metrics should be unregistered after close: %v", values)
+	}
+}
@@ -0,0 +1,61 @@
+package natsxdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// RedisDedupStore 基于Redis SET NX的去重存储
+type RedisDedupStore struct {
+	rdb    *dbx.RedisHelper
+	prefix string
+}
+
+// NewRedisDedupStore prefix为空时使用"natsx:dedup:"
+func NewRedisDedupStore(rdb *dbx.RedisHelper, prefix string) *RedisDedupStore {
+	if prefix == "" {
+		prefix = "natsx:dedup:"
+	}
+	return &RedisDedupStore{rdb: rdb, prefix: prefix}
+}
+
+func (s *RedisDedupStore) Reserve(ctx context.Context, key string, window time.Duration) (*natsx.DedupRecord, error) {
+	data, err := json.Marshal(&natsx.DedupRecord{})
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.rdb.DB().SetNX(ctx, s.prefix+key, data, window).Result()
+	if err != nil || ok {
+		return nil, err
+	}
+	data, err = s.rdb.DB().Get(ctx, s.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// 在两次调用之间过期或被释放，视为正在处理，由重投再次尝试
+		return &natsx.DedupRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &natsx.DedupRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *RedisDedupStore) Complete(ctx context.Context, key string, record *natsx.DedupRecord, window time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.rdb.DB().Set(ctx, s.prefix+key, data, window).Err()
+}
+
+func (s *RedisDedupStore) Release(ctx context.Context, key string) error {
+	return s.rdb.DB().Del(ctx, s.prefix+key).Err()
+}
@@ -0,0 +1,94 @@
+package natsxdb_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/envx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxdb"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openRedis 连接参数见dbx.RedisConfig，Redis不可用时跳过测试
+func openRedis(t *testing.T) (*dbx.RedisHelper, string) {
+	cfg := &dbx.RedisConfig{}
+	if err := envx.LoadEnv(cfg); err != nil {
+		t.Skipf("redis config: %v", err)
+	}
+	cfg.Telemetry = false
+	rdb := &dbx.RedisHelper{}
+	if err := rdb.Open(cfg); err != nil {
+		t.Skipf("redis is unreachable: %v", err)
+	}
+	prefix := fmt.Sprintf("natsxdb:test:%d:", time.Now().UnixNano())
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := rdb.DB().Keys(ctx, prefix+"*").Result()
+		if len(keys) > 0 {
+			rdb.DB().Del(ctx, keys...)
+		}
+		_ = rdb.DB().Close()
+	})
+	return rdb, prefix
+}
+
+func TestRedisDedupStore(t *testing.T) {
+	rdb, prefix := openRedis(t)
+	store := natsxdb.NewRedisDedupStore(rdb, prefix)
+	ctx := context.Background()
+	window := time.Second
+
+	// 并发首次出现时只有一个调用占用成功
+	var (
+		first atomic.Int32
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record, err := store.Reserve(ctx, "test.dedup:1", window)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if record == nil {
+				first.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if first.Load() != 1 {
+		t.Fatalf("expect one first-seen reservation, got %d", first.Load())
+	}
+
+	if err := store.Complete(ctx, "test.dedup:1", &natsx.DedupRecord{Done: true, Data: []byte("ok")}, window); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Reserve(ctx, "test.dedup:1", window); err != nil || record == nil || !record.Done || string(record.Data) != "ok" {
+		t.Fatalf("unexpected completed record: %+v, %v", record, err)
+	}
+	if err := store.Release(ctx, "test.dedup:1"); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Reserve(ctx, "test.dedup:1", window); err != nil || record != nil {
+		t.Fatalf("released key should be reserved again: %+v, %v", record, err)
+	}
+
+	// 超过窗口后记录过期
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		record, err := store.Reserve(ctx, "test.dedup:1", window)
+		if err == nil && record == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("record did not expire: %+v, %v", record, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
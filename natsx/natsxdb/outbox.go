@@ -0,0 +1,233 @@
+package natsxdb
+
+import (
+	"context"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+	"k8s.io/klog/v2"
+	"sync"
+	"time"
+)
+
+type outboxRelayOptions struct {
+	batchSize      int
+	interval       time.Duration
+	baseBackoff    time.Duration
+	maxBackoff     time.Duration
+	publishTimeout time.Duration
+	lease          time.Duration
+	retention      time.Duration
+}
+
+// outboxPurgeInterval 后台循环清理已投递消息的间隔
+const outboxPurgeInterval = time.Minute
+
+type OutboxRelayOption func(options *outboxRelayOptions)
+
+func WithOutboxBatchSize(size int) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.batchSize = size
+	}
+}
+
+// WithOutboxInterval 没有待发送消息时的轮询间隔
+func WithOutboxInterval(interval time.Duration) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.interval = interval
+	}
+}
+
+// WithOutboxBackoff 失败重试的指数退避范围
+func WithOutboxBackoff(base, max time.Duration) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.baseBackoff = base
+		options.maxBackoff = max
+	}
+}
+
+func WithOutboxPublishTimeout(timeout time.Duration) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.publishTimeout = timeout
+	}
+}
+
+// WithOutboxLease 领取一批消息后的租约，租约内未投递完的消息留给下一次领取，默认1分钟
+func WithOutboxLease(lease time.Duration) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.lease = lease
+	}
+}
+
+// WithOutboxRetention 已投递消息的保留时间，超过后由后台循环删除，默认7天，<=0时不删除
+func WithOutboxRetention(retention time.Duration) OutboxRelayOption {
+	return func(options *outboxRelayOptions) {
+		options.retention = retention
+	}
+}
+
+// AddOutbox 编码v并在事务tx中写入发件箱，编码方式与helper.PublishEncoded一致
+func AddOutbox(helper *natsx.NatsHelper, tx *gorm.DB, subject string, v any, codec ...natsx.Codec) (*dbx.OutboxMessage, error) {
+	c := helper.Codec()
+	if len(codec) > 0 && codec[0] != nil {
+		c = codec[0]
+	}
+	msg, err := natsx.EncodeMsg(c, subject, v)
+	if err != nil {
+		return nil, err
+	}
+	if err := helper.ValidateOut(msg); err != nil {
+		return nil, err
+	}
+	return dbx.AddOutbox(tx, subject, msg.Data, msg.Header)
+}
+
+// OutboxRelay 将发件箱中的待发送消息投递到JetStream
+// 使用记录的MsgId作为Nats-Msg-Id，重复投递会在流的去重窗口内被丢弃
+type OutboxRelay struct {
+	helper *natsx.NatsHelper
+	db     *dbx.GormHelper
+	opt    *outboxRelayOptions
+
+	stopOnce sync.Once
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewOutboxRelay 创建中继，目标主题需已被某个JetStream流覆盖
+func NewOutboxRelay(helper *natsx.NatsHelper, db *dbx.GormHelper, option ...OutboxRelayOption) *OutboxRelay {
+	opt := &outboxRelayOptions{
+		batchSize:      100,
+		interval:       time.Second,
+		baseBackoff:    time.Second,
+		maxBackoff:     time.Minute * 5,
+		publishTimeout: time.Second * 5,
+		lease:          time.Minute,
+		retention:      time.Hour * 24 * 7,
+	}
+	for _, o := range option {
+		o(opt)
+	}
+	return &OutboxRelay{helper: helper, db: db, opt: opt}
+}
+
+// Start 启动后台投递协程，会在helper.Close时停止
+func (r *OutboxRelay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.helper.AddCloser(r.Stop)
+	go r.run(ctx)
+}
+
+// Stop 停止投递并等待当前批次完成
+func (r *OutboxRelay) Stop() {
+	r.stopOnce.Do(func() {
+		if r.cancel == nil {
+			return
+		}
+		r.cancel()
+		<-r.done
+	})
+}
+
+func (r *OutboxRelay) run(ctx context.Context) {
+	defer close(r.done)
+	klog.Info("outbox relay started")
+	var purged time.Time
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil {
+			klog.Errorf("outbox relay: %v", err)
+		}
+		if r.opt.retention > 0 && time.Since(purged) >= outboxPurgeInterval {
+			purged = time.Now()
+			if _, err := r.Purge(ctx); err != nil {
+				klog.Errorf("outbox relay: failed to purge sent messages: %v", err)
+			}
+		}
+		// 批次已满时说明可能还有积压，立即继续
+		wait := r.opt.interval
+		if err == nil && n >= r.opt.batchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			klog.Info("outbox relay stopped")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RelayOnce 领取并投递一批消息，返回本批次领取的条数
+// 领取与标记结果各自使用短事务，投递期间不持有数据库锁
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	db := r.db.DBWithCtx(ctx)
+	claimed := time.Now()
+	msgs, err := dbx.ClaimOutbox(db, r.opt.batchSize, r.opt.lease)
+	if err != nil {
+		return 0, err
+	}
+	for i := range msgs {
+		msg := &msgs[i]
+		if ctx.Err() != nil || time.Since(claimed) >= r.opt.lease {
+			// 剩余消息在租约到期后重新领取
+			break
+		}
+		if err := r.publish(ctx, db, msg); err != nil {
+			retryAt := time.Now().Add(r.backoff(msg.Attempts))
+			klog.Warningf("outbox relay: failed to publish %s to %s (attempt %d): %v", msg.MsgId, msg.Subject, msg.Attempts+1, err)
+			if err := dbx.MarkOutboxFailed(db, msg, err, retryAt); err != nil {
+				return len(msgs), err
+			}
+			continue
+		}
+		// 标记失败时消息在租约后重发，由MsgId去重
+		if err := dbx.MarkOutboxSent(db, msg); err != nil {
+			return len(msgs), err
+		}
+	}
+	return len(msgs), nil
+}
+
+// Purge 删除超过保留时间的已投递消息，返回删除的条数
+func (r *OutboxRelay) Purge(ctx context.Context) (int64, error) {
+	if r.opt.retention <= 0 {
+		return 0, nil
+	}
+	return dbx.PurgeOutbox(r.db.DBWithCtx(ctx), time.Now().Add(-r.opt.retention))
+}
+
+func (r *OutboxRelay) publish(ctx context.Context, db *gorm.DB, msg *dbx.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, r.opt.publishTimeout)
+	defer cancel()
+	out := nats.NewMsg(msg.Subject)
+	out.Data = msg.Payload
+	for k, v := range msg.Header {
+		out.Header[k] = v
+	}
+	if err := r.helper.ClaimCheckOut(out); err != nil {
+		return err
+	}
+	if natsx.IsClaimCheck(out) && len(msg.Payload) > 0 {
+		// 保存对象引用，重试时不再重复上传
+		if err := dbx.UpdateOutboxPayload(db, msg, out.Header, nil); err != nil {
+			return err
+		}
+	}
+	_, err := r.helper.Js.PublishMsg(out, nats.MsgId(msg.MsgId), nats.Context(ctx))
+	return err
+}
+
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	backoff := r.opt.baseBackoff
+	for i := 0; i < attempts && backoff < r.opt.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.opt.maxBackoff {
+		backoff = r.opt.maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,198 @@
+package natsxdb_test
+
+import (
+	"context"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxdb"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openOutboxDB(t *testing.T) *dbx.GormHelper {
+	db := &dbx.GormHelper{}
+	if err := db.Open(&dbx.DBConfig{DBUrl: "sqlite:" + filepath.Join(t.TempDir(), "outbox.db")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if err := dbx.AutoMigrateOutbox(db.DB()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	helper := natsxtest.New(t)
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "OUTBOX", Subjects: []string{"outbox.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	db := openOutboxDB(t)
+	ctx := context.Background()
+	add := func(subject, v string) *dbx.OutboxMessage {
+		var msg *dbx.OutboxMessage
+		err := db.DB().Transaction(func(tx *gorm.DB) (err error) {
+			msg, err = natsxdb.AddOutbox(helper, tx, subject, v, natsx.RawCodec{})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	streamMsgs := func() uint64 {
+		info, err := helper.Js.StreamInfo("OUTBOX")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.State.Msgs
+	}
+
+	sent := add("outbox.order.created", "1")
+	add("nostream.order.created", "2")
+	relay := natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxPublishTimeout(time.Millisecond*200),
+		natsxdb.WithOutboxBackoff(time.Hour, time.Hour))
+	n, err := relay.RelayOnce(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected relay result %d: %v", n, err)
+	}
+	if streamMsgs() != 1 {
+		t.Fatalf("expect 1 message in stream, got %d", streamMsgs())
+	}
+	var rows []dbx.OutboxMessage
+	db.DB().Order("id").Find(&rows)
+	if rows[0].Status != dbx.OutboxSent || rows[1].Status != dbx.OutboxPending || rows[1].Attempts != 1 || rows[1].LastError == "" {
+		t.Fatalf("unexpected outbox rows: %+v", rows)
+	}
+	if !rows[1].NextAttemptAt.After(time.Now().Add(time.Minute * 30)) {
+		t.Fatalf("failed message should back off: %s", rows[1].NextAttemptAt)
+	}
+
+	// 标记已投递前崩溃导致的重发由MsgId去重
+	db.DB().Model(&dbx.OutboxMessage{}).Where("id = ?", sent.ID).
+		Updates(map[string]any{"status": dbx.OutboxPending, "next_attempt_at": time.Now()})
+	if n, err = relay.RelayOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("unexpected relay result %d: %v", n, err)
+	}
+	if streamMsgs() != 1 {
+		t.Fatalf("duplicate was not deduplicated, got %d messages", streamMsgs())
+	}
+
+	// 后台循环
+	relay = natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxInterval(time.Millisecond*20))
+	relay.Start()
+	defer relay.Stop()
+	add("outbox.order.paid", "3")
+	waitFor(t, func() bool { return streamMsgs() == 2 })
+}
+
+func TestOutboxRelayClaimCheck(t *testing.T) {
+	helper := natsxtest.New(t)
+	obj, err := natsx.NewObjectStore(helper, &nats.ObjectStoreConfig{Bucket: "outbox_claim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.EnableClaimCheck(obj, 16)
+	db := openOutboxDB(t)
+	ctx := context.Background()
+	var row *dbx.OutboxMessage
+	if err := db.DB().Transaction(func(tx *gorm.DB) (err error) {
+		row, err = natsxdb.AddOutbox(helper, tx, "claim.order.created", strings.Repeat("x", 64), natsx.RawCodec{})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	objects := func() int {
+		infos, err := obj.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(infos)
+	}
+
+	// 流不存在时投递失败，但引用已保存
+	relay := natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxPublishTimeout(time.Millisecond*200))
+	if _, err := relay.RelayOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var failed dbx.OutboxMessage
+	db.DB().Take(&failed, row.ID)
+	if failed.Status != dbx.OutboxPending || len(failed.Payload) != 0 || len(failed.Header[natsx.HeaderClaimCheck]) != 1 {
+		t.Fatalf("claim check reference should be stored: %+v", failed)
+	}
+	if objects() != 1 {
+		t.Fatalf("expect 1 object, got %d", objects())
+	}
+
+	// 重试时使用已保存的引用，不再重复上传
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "CLAIM", Subjects: []string{"claim.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.DB().Model(&dbx.OutboxMessage{}).Where("id = ?", row.ID).Update("next_attempt_at", time.Now())
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("unexpected relay result %d: %v", n, err)
+	}
+	if objects() != 1 {
+		t.Fatalf("payload uploaded again, got %d objects", objects())
+	}
+	stored, err := helper.Js.GetLastMsg("CLAIM", "claim.order.created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Header.Get(natsx.HeaderClaimCheck) != failed.Header[natsx.HeaderClaimCheck][0] {
+		t.Fatalf("unexpected claim check reference: %v", stored.Header)
+	}
+}
+
+func TestOutboxRelayPurge(t *testing.T) {
+	helper := natsxtest.New(t)
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "OUTBOX", Subjects: []string{"outbox.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	db := openOutboxDB(t)
+	ctx := context.Background()
+	for _, subject := range []string{"outbox.order.created", "nostream.order.created"} {
+		if err := db.DB().Transaction(func(tx *gorm.DB) error {
+			_, err := dbx.AddOutbox(tx, subject, []byte("1"), nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() (n int64) {
+		db.DB().Model(&dbx.OutboxMessage{}).Count(&n)
+		return
+	}
+
+	relay := natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxPublishTimeout(time.Millisecond*200))
+	if _, err := relay.RelayOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 默认保留7天
+	if n, err := relay.Purge(ctx); err != nil || n != 0 || count() != 2 {
+		t.Fatalf("unexpected purge result %d: %v", n, err)
+	}
+	relay = natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxRetention(time.Nanosecond))
+	if n, err := relay.Purge(ctx); err != nil || n != 1 || count() != 1 {
+		t.Fatalf("unexpected purge result %d: %v", n, err)
+	}
+	relay = natsxdb.NewOutboxRelay(helper, db, natsxdb.WithOutboxRetention(0))
+	if n, err := relay.Purge(ctx); err != nil || n != 0 {
+		t.Fatalf("unexpected purge result %d: %v", n, err)
+	}
+}
@@ -0,0 +1,124 @@
+package natsxdb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/TiyaAnlite/FocotServicesCommon/dbx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// RedisScheduleStore 基于Redis有序集合的存储，分数为发送时间，领取时将分数推后租约时间
+type RedisScheduleStore struct {
+	rdb    *dbx.RedisHelper
+	prefix string
+}
+
+// NewRedisScheduleStore prefix为空时使用"natsx:schedule:"
+func NewRedisScheduleStore(rdb *dbx.RedisHelper, prefix string) *RedisScheduleStore {
+	if prefix == "" {
+		prefix = "natsx:schedule:"
+	}
+	return &RedisScheduleStore{rdb: rdb, prefix: prefix}
+}
+
+func (s *RedisScheduleStore) queueKey() string {
+	return s.prefix + "queue"
+}
+
+func (s *RedisScheduleStore) msgKey(id string) string {
+	return s.prefix + "msg:" + id
+}
+
+// leaseKey 领取时写入并在租约结束时过期，存在时消息无法取消
+func (s *RedisScheduleStore) leaseKey(id string) string {
+	return s.prefix + "lease:" + id
+}
+
+func (s *RedisScheduleStore) Add(ctx context.Context, msg *natsx.ScheduledMsg) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdb.DB().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.msgKey(msg.Id), data, 0)
+		pipe.ZAdd(ctx, s.queueKey(), redis.Z{Score: float64(msg.At.UnixMilli()), Member: msg.Id})
+		return nil
+	})
+	return err
+}
+
+// cancelScript 租约未到期时返回-1，否则移除消息并返回移除的条数
+var cancelScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return -1
+end
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+func (s *RedisScheduleStore) Cancel(ctx context.Context, id string) (bool, error) {
+	removed, err := cancelScript.Run(ctx, s.rdb.DB(),
+		[]string{s.queueKey(), s.msgKey(id), s.leaseKey(id)}, id).Int()
+	if err != nil {
+		return false, err
+	}
+	if removed < 0 {
+		return false, natsx.ErrScheduleInFlight
+	}
+	return removed == 1, nil
+}
+
+// claimScript 原子地取出到期的消息ID，将其分数推后到租约结束时间并写入租约键
+var claimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[3], id)
+	redis.call('SET', ARGV[5] .. id, '1', 'PX', ARGV[4])
+end
+return ids
+`)
+
+func (s *RedisScheduleStore) Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]*natsx.ScheduledMsg, error) {
+	ids, err := claimScript.Run(ctx, s.rdb.DB(), []string{s.queueKey()},
+		now.UnixMilli(), limit, now.Add(lease).UnixMilli(), max(lease.Milliseconds(), 1), s.leaseKey("")).StringSlice()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.msgKey(id)
+	}
+	values, err := s.rdb.DB().MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*natsx.ScheduledMsg, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// 消息体已被删除，清理残留的队列成员
+			s.rdb.DB().ZRem(ctx, s.queueKey(), ids[i])
+			continue
+		}
+		msg := &natsx.ScheduledMsg{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (s *RedisScheduleStore) Done(ctx context.Context, id string) error {
+	_, err := s.rdb.DB().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.queueKey(), id)
+		pipe.Del(ctx, s.msgKey(id), s.leaseKey(id))
+		return nil
+	})
+	return err
+}
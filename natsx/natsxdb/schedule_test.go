@@ -0,0 +1,93 @@
+package natsxdb_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxdb"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+func TestRedisScheduleStore(t *testing.T) {
+	rdb, prefix := openRedis(t)
+	store := natsxdb.NewRedisScheduleStore(rdb, prefix)
+	ctx := context.Background()
+	now := time.Now()
+	for _, msg := range []*natsx.ScheduledMsg{
+		{Id: "due", Subject: "test.schedule.due", Data: []byte("due"), At: now.Add(-time.Second)},
+		{Id: "later", Subject: "test.schedule.later", At: now.Add(time.Hour)},
+		{Id: "cancelled", Subject: "test.schedule.cancelled", At: now.Add(-time.Second)},
+	} {
+		if err := store.Add(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := store.Cancel(ctx, "cancelled"); !ok || err != nil {
+		t.Fatalf("failed to cancel: %v, %v", ok, err)
+	}
+	if ok, _ := store.Cancel(ctx, "cancelled"); ok {
+		t.Fatal("cancel twice should return false")
+	}
+
+	msgs, err := store.Claim(ctx, now, 10, time.Minute)
+	if err != nil || len(msgs) != 1 || msgs[0].Id != "due" || string(msgs[0].Data) != "due" {
+		t.Fatalf("unexpected claimed messages: %+v, %v", msgs, err)
+	}
+	if ok, err := store.Cancel(ctx, "due"); ok || !errors.Is(err, natsx.ErrScheduleInFlight) {
+		t.Fatalf("claimed message should not be cancelled: %v, %v", ok, err)
+	}
+	// 租约内其他副本无法领取，租约到期后可以重新领取
+	if msgs, err := store.Claim(ctx, now, 10, time.Minute); err != nil || len(msgs) != 0 {
+		t.Fatalf("claimed message should be leased: %+v, %v", msgs, err)
+	}
+	if msgs, err := store.Claim(ctx, now.Add(time.Minute*2), 10, time.Minute); err != nil || len(msgs) != 1 {
+		t.Fatalf("expired lease should be claimed again: %+v, %v", msgs, err)
+	}
+	if err := store.Done(ctx, "due"); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := store.Claim(ctx, now.Add(time.Hour*2), 10, time.Minute); err != nil || len(msgs) != 1 || msgs[0].Id != "later" {
+		t.Fatalf("unexpected claimed messages: %+v, %v", msgs, err)
+	}
+}
+
+func TestRedisScheduler(t *testing.T) {
+	rdb, prefix := openRedis(t)
+	// 连接不接收自己发送的消息，订阅使用另一个连接
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	helper, subscriber := connect(), connect()
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "SCHEDULE", Subjects: []string{"test.schedule.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *nats.Msg, 1)
+	if err := subscriber.AddNatsHandler("test.schedule.>", func(msg *nats.Msg) {
+		received <- msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = subscriber.Nc.Flush()
+	scheduler := natsx.NewScheduler(helper, natsxdb.NewRedisScheduleStore(rdb, prefix), natsx.WithSchedulerInterval(time.Millisecond*20))
+	if _, err := scheduler.PublishAfter(context.Background(), "test.schedule.redis", "redis", time.Millisecond*100, natsx.RawCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	select {
+	case msg := <-received:
+		if string(msg.Data) != "redis" {
+			t.Fatalf("unexpected message: %s", msg.Data)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("scheduled message was not delivered")
+	}
+}
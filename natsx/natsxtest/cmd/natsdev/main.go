@@ -0,0 +1,37 @@
+// natsdev 启动本地开发用的NATS服务
+//
+//	go run ./natsx/natsxtest/cmd/natsdev -port 4222 -store ./.nats
+package main
+
+import (
+	"flag"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"k8s.io/klog/v2"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	port := flag.Int("port", 4222, "client port, -1 for random")
+	store := flag.String("store", "", "JetStream store directory, temporary if empty")
+	noJetStream := flag.Bool("no-jetstream", false, "disable JetStream")
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	options := []natsxtest.Option{natsxtest.WithPort(*port), natsxtest.WithStoreDir(*store), natsxtest.WithLogging()}
+	if *noJetStream {
+		options = append(options, natsxtest.WithoutJetStream())
+	}
+	s, err := natsxtest.Start(options...)
+	if err != nil {
+		klog.Fatalf("failed to start nats server: %v", err)
+	}
+	klog.Infof("nats server ready, NATS_URL=%s", s.ClientURL())
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	klog.Info("shutting down nats server")
+	s.Shutdown()
+}
@@ -0,0 +1,153 @@
+package natsxtest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/nats-io/nats-server/v2/server"
+	"os"
+	"testing"
+	"time"
+)
+
+type serverOptions struct {
+	port      int
+	storeDir  string
+	jetStream bool
+	logging   bool
+	configure func(opts *server.Options)
+}
+
+type Option func(options *serverOptions)
+
+// WithPort 监听端口，默认随机
+func WithPort(port int) Option {
+	return func(options *serverOptions) {
+		options.port = port
+	}
+}
+
+// WithStoreDir JetStream存储目录，默认使用临时目录并在关闭时删除
+func WithStoreDir(dir string) Option {
+	return func(options *serverOptions) {
+		options.storeDir = dir
+	}
+}
+
+// WithoutJetStream 不启用JetStream
+func WithoutJetStream() Option {
+	return func(options *serverOptions) {
+		options.jetStream = false
+	}
+}
+
+// WithLogging 输出服务端日志
+func WithLogging() Option {
+	return func(options *serverOptions) {
+		options.logging = true
+	}
+}
+
+// WithServerOptions 直接修改nats-server的配置
+func WithServerOptions(configure func(opts *server.Options)) Option {
+	return func(options *serverOptions) {
+		options.configure = configure
+	}
+}
+
+// Server 进程内的NATS服务
+type Server struct {
+	*server.Server
+	tempDir string
+}
+
+// Start 启动进程内的NATS服务，默认监听127.0.0.1的随机端口并启用JetStream
+func Start(option ...Option) (*Server, error) {
+	opt := &serverOptions{port: server.RANDOM_PORT, jetStream: true}
+	for _, o := range option {
+		o(opt)
+	}
+	s := &Server{}
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      opt.port,
+		JetStream: opt.jetStream,
+		StoreDir:  opt.storeDir,
+		NoLog:     !opt.logging,
+		NoSigs:    true,
+	}
+	if opts.JetStream && opts.StoreDir == "" {
+		dir, err := os.MkdirTemp("", "natsxtest-")
+		if err != nil {
+			return nil, err
+		}
+		s.tempDir, opts.StoreDir = dir, dir
+	}
+	if opt.configure != nil {
+		opt.configure(opts)
+	}
+	var err error
+	if s.Server, err = server.NewServer(opts); err != nil {
+		s.removeTempDir()
+		return nil, err
+	}
+	if opt.logging {
+		s.ConfigureLogger()
+	}
+	go s.Server.Start()
+	if !s.ReadyForConnections(time.Second * 10) {
+		s.Shutdown()
+		return nil, errors.New("nats server not ready for connections")
+	}
+	return s, nil
+}
+
+// Config 连接该服务使用的配置，不启用遥测
+func (s *Server) Config() natsx.NatsConfig {
+	return natsx.NatsConfig{NatsUrl: s.ClientURL()}
+}
+
+// Connect 创建连接到该服务的NatsHelper
+func (s *Server) Connect() (*natsx.NatsHelper, error) {
+	helper := &natsx.NatsHelper{}
+	if err := helper.Open(s.Config()); err != nil {
+		return nil, fmt.Errorf("failed to connect embedded nats server: %w", err)
+	}
+	return helper, nil
+}
+
+// Shutdown 关闭服务并删除临时存储目录
+func (s *Server) Shutdown() {
+	s.Server.Shutdown()
+	s.WaitForShutdown()
+	s.removeTempDir()
+}
+
+func (s *Server) removeTempDir() {
+	if s.tempDir != "" {
+		_ = os.RemoveAll(s.tempDir)
+	}
+}
+
+// New 为测试启动服务并返回已连接的NatsHelper，测试结束时自动关闭
+func New(t testing.TB, option ...Option) *natsx.NatsHelper {
+	t.Helper()
+	s := NewServer(t, option...)
+	helper, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(helper.Close)
+	return helper
+}
+
+// NewServer 为测试启动服务，测试结束时自动关闭
+func NewServer(t testing.TB, option ...Option) *Server {
+	t.Helper()
+	s, err := Start(append([]Option{WithStoreDir(t.TempDir())}, option...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
@@ -0,0 +1,174 @@
+package natsx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"io"
+	"k8s.io/klog/v2"
+	"strings"
+)
+
+// ObjectStore JetStream对象存储，用于超出消息大小限制的数据
+type ObjectStore struct {
+	Bucket   string
+	Store    nats.ObjectStore
+	watchers watcherSet
+}
+
+// NewObjectStore 创建或绑定已有的对象存储桶
+// 返回的ObjectStore会在helper.Close时自动关闭
+func NewObjectStore(helper *NatsHelper, cfg *nats.ObjectStoreConfig) (*ObjectStore, error) {
+	store, err := helper.Js.ObjectStore(cfg.Bucket)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		klog.V(1).Infof("creating object store bucket: %s", cfg.Bucket)
+		store, err = helper.Js.CreateObjectStore(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	helper.objectStores.Store(cfg.Bucket, store)
+	obj := &ObjectStore{Bucket: cfg.Bucket, Store: store}
+	helper.addCloser(obj.Close)
+	return obj, nil
+}
+
+// Put 从reader写入对象，meta.Name为对象名
+func (obj *ObjectStore) Put(meta *nats.ObjectMeta, reader io.Reader) (*nats.ObjectInfo, error) {
+	return obj.Store.Put(meta, reader)
+}
+
+// Get 将对象内容写入writer
+func (obj *ObjectStore) Get(name string, writer io.Writer) (*nats.ObjectInfo, error) {
+	result, err := obj.Store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	if _, err := io.Copy(writer, result); err != nil {
+		return nil, err
+	}
+	return result.Info()
+}
+
+func (obj *ObjectStore) GetInfo(name string) (*nats.ObjectInfo, error) {
+	return obj.Store.GetInfo(name)
+}
+
+func (obj *ObjectStore) UpdateMeta(name string, meta *nats.ObjectMeta) error {
+	return obj.Store.UpdateMeta(name, meta)
+}
+
+func (obj *ObjectStore) Delete(name string) error {
+	return obj.Store.Delete(name)
+}
+
+// List 列出所有对象，存储桶为空时返回空列表
+func (obj *ObjectStore) List() ([]*nats.ObjectInfo, error) {
+	infos, err := obj.Store.List()
+	if errors.Is(err, nats.ErrNoObjectsFound) {
+		return []*nats.ObjectInfo{}, nil
+	}
+	return infos, err
+}
+
+// Watch 监听对象的变更，ctx结束或ObjectStore关闭时关闭通道
+func (obj *ObjectStore) Watch(ctx context.Context, opts ...nats.WatchOpt) (<-chan *nats.ObjectInfo, error) {
+	watcher, err := obj.Store.Watch(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return forward(ctx, &obj.watchers, watcher, watcher.Updates(), func(info *nats.ObjectInfo) (*nats.ObjectInfo, bool) {
+		return info, true
+	})
+}
+
+// Close 停止所有监听
+func (obj *ObjectStore) Close() {
+	obj.watchers.close()
+}
+
+// HeaderClaimCheck 消息体已转存时携带的引用，格式为bucket/name
+const HeaderClaimCheck = "Nats-Claim-Check"
+
+// claimCheckHeadroom 默认阈值为服务器MaxPayload减去该值，为消息头预留空间
+const claimCheckHeadroom = 4 << 10
+
+// ClaimCheck 将超出阈值的消息体存入对象存储，只发送引用
+// 对象不会在处理后删除(可能有多个订阅者)，应通过存储桶的TTL清理
+type ClaimCheck struct {
+	Store     *ObjectStore
+	Threshold int
+}
+
+// EnableClaimCheck 为经由helper发送的消息启用ClaimCheck，threshold<=0时按服务器MaxPayload计算
+// 接收端无需启用，经由helper注册的处理器都会自动取回消息体
+func (helper *NatsHelper) EnableClaimCheck(store *ObjectStore, threshold int) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.claimCheck = &ClaimCheck{Store: store, Threshold: threshold}
+}
+
+func (helper *NatsHelper) getClaimCheck() *ClaimCheck {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	return helper.claimCheck
+}
+
+func (cc *ClaimCheck) oversized(helper *NatsHelper, msg *nats.Msg) bool {
+	threshold := cc.Threshold
+	if threshold <= 0 {
+		threshold = int(helper.Nc.MaxPayload()) - claimCheckHeadroom
+	}
+	return len(msg.Data) > threshold
+}
+
+func (cc *ClaimCheck) store(msg *nats.Msg) error {
+	name := nuid.Next()
+	meta := &nats.ObjectMeta{Name: name, Description: msg.Subject}
+	if contentType := msg.Header.Get(HeaderContentType); contentType != "" {
+		meta.Headers = nats.Header{HeaderContentType: []string{contentType}}
+	}
+	if _, err := cc.Store.Store.Put(meta, bytes.NewReader(msg.Data)); err != nil {
+		return fmt.Errorf("failed to store claim check payload: %w", err)
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderClaimCheck, cc.Store.Bucket+"/"+name)
+	msg.Data = nil
+	return nil
+}
+
+// IsClaimCheck 消息体是否已转存到对象存储
+func IsClaimCheck(msg *nats.Msg) bool {
+	return msg.Header.Get(HeaderClaimCheck) != ""
+}
+
+// resolveClaimCheck 从对象存储取回消息体并移除引用头
+func (helper *NatsHelper) resolveClaimCheck(msg *nats.Msg) error {
+	bucket, name, ok := strings.Cut(msg.Header.Get(HeaderClaimCheck), "/")
+	if !ok {
+		return fmt.Errorf("invalid claim check: %s", msg.Header.Get(HeaderClaimCheck))
+	}
+	var store nats.ObjectStore
+	if cached, ok := helper.objectStores.Load(bucket); ok {
+		store = cached.(nats.ObjectStore)
+	} else {
+		var err error
+		if store, err = helper.Js.ObjectStore(bucket); err != nil {
+			return err
+		}
+		helper.objectStores.Store(bucket, store)
+	}
+	data, err := store.GetBytes(name)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	msg.Header.Del(HeaderClaimCheck)
+	return nil
+}
@@ -0,0 +1,154 @@
+package natsx_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+func nextObject(t *testing.T, ch <-chan *nats.ObjectInfo) *nats.ObjectInfo {
+	t.Helper()
+	select {
+	case info, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return info
+	case <-time.After(time.Second * 5):
+		t.Fatal("no watch update")
+	}
+	panic("unreachable")
+}
+
+func TestObjectStore(t *testing.T) {
+	helper := natsxtest.New(t)
+	obj, err := natsx.NewObjectStore(helper, &nats.ObjectStoreConfig{Bucket: "test_object"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := obj.List(); err != nil || len(infos) != 0 {
+		t.Fatalf("expect empty bucket, got %v %v", infos, err)
+	}
+
+	data := bytes.Repeat([]byte("a"), 1<<10)
+	if _, err := obj.Put(&nats.ObjectMeta{Name: "a"}, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	info, err := obj.Get("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) || info.Size != uint64(len(data)) {
+		t.Fatalf("unexpected object: %d bytes, info %+v", buf.Len(), info)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := obj.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := nextObject(t, updates); info.Name != "a" {
+		t.Fatalf("expect initial object a, got %s", info.Name)
+	}
+	if _, err := obj.Put(&nats.ObjectMeta{Name: "b"}, bytes.NewReader([]byte("b"))); err != nil {
+		t.Fatal(err)
+	}
+	if info := nextObject(t, updates); info.Name != "b" || info.Deleted {
+		t.Fatalf("unexpected update: %+v", info)
+	}
+	if infos, err := obj.List(); err != nil || len(infos) != 2 {
+		t.Fatalf("expect 2 objects, got %v %v", infos, err)
+	}
+	if err := obj.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if info := nextObject(t, updates); info.Name != "a" || !info.Deleted {
+		t.Fatalf("expect delete of a, got %+v", info)
+	}
+
+	cancel()
+	for range updates {
+	}
+}
+
+func TestClaimCheck(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	helper, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(helper.Close)
+	obj, err := natsx.NewObjectStore(helper, &nats.ObjectStoreConfig{Bucket: "test_claim_check"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.EnableClaimCheck(obj, 64)
+
+	// 连接不接收自己发送的消息，接收端使用另一个未启用ClaimCheck的连接
+	consumer, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(consumer.Close)
+	raw := make(chan *nats.Msg, 2)
+	if _, err := consumer.Nc.ChanSubscribe("test.claim", raw); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *nats.Msg, 2)
+	if err := consumer.AddNatsHandler("test.claim", func(msg *nats.Msg) {
+		received <- msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = consumer.Nc.Flush()
+
+	data := bytes.Repeat([]byte("x"), 1<<10)
+	msg := nats.NewMsg("test.claim")
+	msg.Data = data
+	msg.Header.Set(natsx.HeaderContentType, "application/octet-stream")
+	if err := helper.PublishMsgCtx(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-raw:
+		if !natsx.IsClaimCheck(msg) || len(msg.Data) != 0 {
+			t.Fatalf("expect claim check reference on the wire, got %d bytes, header %v", len(msg.Data), msg.Header)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no raw message")
+	}
+	select {
+	case msg := <-received:
+		if !bytes.Equal(msg.Data, data) {
+			t.Fatalf("expect resolved payload, got %d bytes", len(msg.Data))
+		}
+		if natsx.IsClaimCheck(msg) {
+			t.Fatalf("claim check header should be removed: %v", msg.Header)
+		}
+		if contentType := msg.Header.Get(natsx.HeaderContentType); contentType != "application/octet-stream" {
+			t.Fatalf("unexpected content type: %s", contentType)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no resolved message")
+	}
+
+	// 未超出阈值的消息直接发送
+	if err := helper.Publish("test.claim", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-raw:
+		if natsx.IsClaimCheck(msg) || string(msg.Data) != "small" {
+			t.Fatalf("small message should not be stored: %q %v", msg.Data, msg.Header)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no raw message")
+	}
+}
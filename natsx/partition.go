@@ -0,0 +1,328 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"hash/fnv"
+	"k8s.io/klog/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PartitionConfig 分区消费的配置，分区号作为主题的最后一个token，如orders.events.3
+type PartitionConfig struct {
+	// Name 消费组名，用于持久消费者与成员存储桶的命名
+	Name   string
+	Stream string
+	// Subject 分区主题前缀
+	Subject    string
+	Partitions int
+}
+
+// SubjectFor 按key计算分区后的发送主题，相同key总是落在同一分区
+func (cfg *PartitionConfig) SubjectFor(key string) string {
+	return fmt.Sprintf("%s.%d", cfg.Subject, PartitionOf(key, cfg.Partitions))
+}
+
+// PartitionOf key所在的分区
+func PartitionOf(key string, partitions int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// PartitionHandler 分区消息处理器，返回nil时确认消息，返回错误时延迟重投
+// 重投完成前同一分区的后续消息不会被处理
+type PartitionHandler func(ctx context.Context, msg *nats.Msg) error
+
+type partitionOptions struct {
+	id         string
+	heartbeat  time.Duration
+	retryDelay time.Duration
+	ackWait    time.Duration
+}
+
+type PartitionOption func(options *partitionOptions)
+
+// WithPartitionId 副本标识，默认随机生成
+func WithPartitionId(id string) PartitionOption {
+	return func(options *partitionOptions) {
+		options.id = id
+	}
+}
+
+// WithPartitionHeartbeat 成员心跳间隔，副本失联三个周期后其分区会被重新分配，默认2秒
+func WithPartitionHeartbeat(heartbeat time.Duration) PartitionOption {
+	return func(options *partitionOptions) {
+		options.heartbeat = heartbeat
+	}
+}
+
+// WithPartitionRetryDelay 处理失败后重投的延迟，默认1秒
+func WithPartitionRetryDelay(delay time.Duration) PartitionOption {
+	return func(options *partitionOptions) {
+		options.retryDelay = delay
+	}
+}
+
+// WithPartitionAckWait 未确认消息的重投等待时间，默认30秒
+func WithPartitionAckWait(ackWait time.Duration) PartitionOption {
+	return func(options *partitionOptions) {
+		options.ackWait = ackWait
+	}
+}
+
+// PartitionedConsumer 按分区有序消费JetStream消息
+// 每个分区对应一个MaxAckPending为1的持久消费者，同一分区的消息严格按顺序处理，不同分区并行处理
+// 副本通过KV存储桶登记心跳，分区按成员列表确定性地分配，成员变化时自动重新分配
+type PartitionedConsumer struct {
+	helper  *NatsHelper
+	cfg     PartitionConfig
+	handler PartitionHandler
+	opt     *partitionOptions
+	members *KV[string]
+
+	lock    sync.Mutex
+	workers map[int]context.CancelFunc
+	running sync.WaitGroup
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewPartitionedConsumer 创建分区消费者并确保每个分区的持久消费者存在
+func NewPartitionedConsumer(helper *NatsHelper, cfg PartitionConfig, handler PartitionHandler, option ...PartitionOption) (*PartitionedConsumer, error) {
+	if cfg.Partitions <= 0 {
+		return nil, errors.New("partitions must be positive")
+	}
+	opt := &partitionOptions{
+		id:         nuid.Next(),
+		heartbeat:  time.Second * 2,
+		retryDelay: time.Second,
+		ackWait:    time.Second * 30,
+	}
+	for _, o := range option {
+		o(opt)
+	}
+	for p := 0; p < cfg.Partitions; p++ {
+		_, err := helper.Js.AddConsumer(cfg.Stream, &nats.ConsumerConfig{
+			Durable:       partitionDurable(cfg.Name, p),
+			FilterSubject: fmt.Sprintf("%s.%d", cfg.Subject, p),
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       opt.ackWait,
+			MaxAckPending: 1,
+			DeliverPolicy: nats.DeliverAllPolicy,
+		})
+		if err != nil && !errors.Is(err, nats.ErrConsumerNameAlreadyInUse) {
+			return nil, fmt.Errorf("failed to create consumer for partition %d: %w", p, err)
+		}
+	}
+	members, err := NewKV[string](helper, &nats.KeyValueConfig{
+		Bucket:      cfg.Name + "_members",
+		Description: "natsx partitioned consumer members",
+		TTL:         opt.heartbeat * 3,
+		History:     1,
+	}, RawCodec{})
+	if err != nil {
+		return nil, err
+	}
+	return &PartitionedConsumer{
+		helper:  helper,
+		cfg:     cfg,
+		handler: handler,
+		opt:     opt,
+		members: members,
+		workers: make(map[int]context.CancelFunc),
+	}, nil
+}
+
+func partitionDurable(name string, partition int) string {
+	return name + "-" + strconv.Itoa(partition)
+}
+
+// Start 加入消费组并开始消费，会在helper.Close时停止
+func (c *PartitionedConsumer) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cancel != nil {
+		return errors.New("partitioned consumer already started")
+	}
+	watcher, err := c.members.Store.WatchAll()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel, c.done = cancel, make(chan struct{})
+	c.helper.addCloser(c.Stop)
+	go c.run(ctx, watcher)
+	return nil
+}
+
+// Stop 退出消费组，等待正在处理的消息完成
+func (c *PartitionedConsumer) Stop() {
+	c.lock.Lock()
+	cancel, done := c.cancel, c.done
+	c.cancel = nil
+	c.lock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Owned 当前副本负责的分区
+func (c *PartitionedConsumer) Owned() []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	owned := make([]int, 0, len(c.workers))
+	for p := range c.workers {
+		owned = append(owned, p)
+	}
+	sort.Ints(owned)
+	return owned
+}
+
+func (c *PartitionedConsumer) run(ctx context.Context, watcher nats.KeyWatcher) {
+	defer close(c.done)
+	defer func() {
+		_ = watcher.Stop()
+		c.assign(nil)
+		c.running.Wait()
+		// 主动离开，其他副本无需等待心跳过期
+		if err := c.members.Delete(c.opt.id); err != nil {
+			klog.Warningf("partitioned consumer %s: failed to leave: %v", c.cfg.Name, err)
+		}
+	}()
+	ticker := time.NewTicker(c.opt.heartbeat)
+	defer ticker.Stop()
+	for {
+		c.rebalance(ctx)
+		for changed := false; !changed; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed = true
+			case entry := <-watcher.Updates():
+				// 忽略自身的心跳，只在成员加入或离开时立即重新分配
+				changed = entry != nil && (entry.Key() != c.opt.id || entry.Operation() != nats.KeyValuePut)
+			}
+		}
+	}
+}
+
+// rebalance 登记心跳并按当前成员列表重新计算负责的分区
+func (c *PartitionedConsumer) rebalance(ctx context.Context) {
+	if _, err := c.members.Put(c.opt.id, time.Now().Format(time.RFC3339)); err != nil {
+		klog.Warningf("partitioned consumer %s: failed to heartbeat: %v", c.cfg.Name, err)
+		return
+	}
+	members, err := c.members.Keys()
+	if err != nil {
+		klog.Warningf("partitioned consumer %s: failed to list members: %v", c.cfg.Name, err)
+		return
+	}
+	// 列出键期间的心跳更新可能使同一成员出现两次
+	sort.Strings(members)
+	members = slices.Compact(members)
+	index := sort.SearchStrings(members, c.opt.id)
+	if index >= len(members) || members[index] != c.opt.id {
+		return
+	}
+	owned := make(map[int]bool)
+	for p := index; p < c.cfg.Partitions; p += len(members) {
+		owned[p] = true
+	}
+	c.startWorkers(ctx, owned)
+}
+
+func (c *PartitionedConsumer) startWorkers(ctx context.Context, owned map[int]bool) {
+	c.assign(owned)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for p := range owned {
+		if _, ok := c.workers[p]; ok {
+			continue
+		}
+		sub, err := c.helper.Js.PullSubscribe(fmt.Sprintf("%s.%d", c.cfg.Subject, p), "",
+			nats.Bind(c.cfg.Stream, partitionDurable(c.cfg.Name, p)))
+		if err != nil {
+			klog.Errorf("partitioned consumer %s: failed to bind partition %d: %v", c.cfg.Name, p, err)
+			continue
+		}
+		workerCtx, cancel := context.WithCancel(ctx)
+		c.workers[p] = cancel
+		c.running.Add(1)
+		klog.V(1).Infof("partitioned consumer %s: %s owns partition %d", c.cfg.Name, c.opt.id, p)
+		go c.consume(workerCtx, p, sub)
+	}
+}
+
+// assign 停止不再负责的分区，不等待正在处理的消息以免阻塞心跳
+// 新的负责者在此期间拉取不会乱序，消费者的MaxAckPending为1保证同一时刻只有一条消息未确认
+func (c *PartitionedConsumer) assign(owned map[int]bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for p, cancel := range c.workers {
+		if !owned[p] {
+			cancel()
+			delete(c.workers, p)
+		}
+	}
+}
+
+func (c *PartitionedConsumer) consume(ctx context.Context, partition int, sub *nats.Subscription) {
+	defer c.running.Done()
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	for ctx.Err() == nil {
+		// 不随分区停止取消拉取，否则服务端可能把消息投递给已放弃的拉取请求，
+		// 在MaxAckPending为1时整个分区会阻塞到AckWait超时
+		msgs, err := sub.Fetch(1, nats.MaxWait(c.opt.heartbeat))
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, nats.ErrTimeout) {
+				klog.Warningf("partitioned consumer %s: failed to fetch partition %d: %v", c.cfg.Name, partition, err)
+				time.Sleep(c.opt.retryDelay)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			c.handle(msg)
+		}
+	}
+}
+
+func (c *PartitionedConsumer) handle(msg *nats.Msg) {
+	var handled bool
+	var err error
+	// 经过helper的中间件、ClaimCheck与schema校验，分区停止时仍会完成当前消息
+	c.helper.wrapHandler(func(ctx context.Context, msg *nats.Msg) {
+		handled = true
+		// 未配置Recover中间件时panic会终止拉取协程，在此恢复并重投
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("handler panic: %v", r)
+			}
+		}()
+		err = c.handler(ctx, msg)
+	})(msg)
+	if !handled {
+		// 已被schema校验终止或ClaimCheck失败，后者会在AckWait后重投
+		return
+	}
+	if err != nil {
+		klog.Warningf("partitioned consumer %s: failed to handle %s: %v", c.cfg.Name, msg.Subject, err)
+		_ = msg.NakWithDelay(c.opt.retryDelay)
+		return
+	}
+	if err := msg.Ack(); err != nil {
+		klog.Warningf("partitioned consumer %s: failed to ack %s: %v", c.cfg.Name, msg.Subject, err)
+	}
+}
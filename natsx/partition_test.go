@@ -0,0 +1,127 @@
+package natsx_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartitionedConsumer(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	publisher, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(publisher.Close)
+	if _, err := publisher.Js.AddStream(&nats.StreamConfig{Name: "PART", Subjects: []string{"test.part.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := natsx.PartitionConfig{Name: "part", Stream: "PART", Subject: "test.part", Partitions: 4}
+
+	var lock sync.Mutex
+	received := make(map[string][]int)
+	failed, panicked := false, false
+	handler := func(ctx context.Context, msg *nats.Msg) error {
+		key, seq, _ := strings.Cut(string(msg.Data), ":")
+		n, _ := strconv.Atoi(seq)
+		lock.Lock()
+		defer lock.Unlock()
+		// 第一次处理失败的消息重投前，同一key的后续消息不能被处理
+		if key == "k0" && n == 1 && !failed {
+			failed = true
+			return fmt.Errorf("temporary failure")
+		}
+		// 未配置Recover中间件时panic同样重投，且不影响后续消费
+		if key == "k3" && n == 2 && !panicked {
+			panicked = true
+			panic("temporary panic")
+		}
+		received[key] = append(received[key], n)
+		return nil
+	}
+	var consumers []*natsx.PartitionedConsumer
+	for i := 0; i < 2; i++ {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		consumer, err := natsx.NewPartitionedConsumer(helper, cfg, handler,
+			natsx.WithPartitionId(fmt.Sprintf("replica-%d", i)),
+			natsx.WithPartitionHeartbeat(time.Millisecond*200),
+			natsx.WithPartitionRetryDelay(time.Millisecond*50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := consumer.Start(); err != nil {
+			t.Fatal(err)
+		}
+		consumers = append(consumers, consumer)
+	}
+	// 两个副本平分全部分区
+	waitFor(t, func() bool {
+		return len(consumers[0].Owned()) == 2 && len(consumers[1].Owned()) == 2
+	})
+	seen := make(map[int]bool)
+	for _, c := range consumers {
+		for _, p := range c.Owned() {
+			if seen[p] {
+				t.Fatalf("partition %d owned twice: %v %v", p, consumers[0].Owned(), consumers[1].Owned())
+			}
+			seen[p] = true
+		}
+	}
+
+	const keys, perKey = 8, 20
+	for n := 0; n < perKey; n++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("k%d", k)
+			if _, err := publisher.Js.Publish(cfg.SubjectFor(key), []byte(fmt.Sprintf("%s:%d", key, n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for k := 0; k < keys; k++ {
+			if len(received[fmt.Sprintf("k%d", k)]) < perKey {
+				return false
+			}
+		}
+		return true
+	})
+	lock.Lock()
+	for key, seqs := range received {
+		for i, n := range seqs {
+			if i != n {
+				t.Fatalf("%s out of order: %v", key, seqs)
+			}
+		}
+	}
+	lock.Unlock()
+
+	// 副本离开后剩余副本接管所有分区
+	consumers[1].Stop()
+	waitFor(t, func() bool {
+		return fmt.Sprint(consumers[0].Owned()) == fmt.Sprint([]int{0, 1, 2, 3})
+	})
+	if _, err := publisher.Js.Publish(cfg.SubjectFor("k1"), []byte("k1:20")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.Js.Publish(cfg.SubjectFor("k2"), []byte("k2:20")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received["k1"]) == perKey+1 && len(received["k2"]) == perKey+1
+	})
+}
@@ -0,0 +1,492 @@
+package natsx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流式应答协议：请求携带窗口大小，应答方按序发送分块，最后发送空消息体的结束标记
+// 结束标记上的服务错误头即为错误尾部；请求方通过分块中的控制主题确认进度或取消
+const (
+	HeaderStreamWindow  = "Nats-Stream-Window"
+	HeaderStreamSeq     = "Nats-Stream-Seq"
+	HeaderStreamEnd     = "Nats-Stream-End"
+	HeaderStreamControl = "Nats-Stream-Control"
+	HeaderStreamAck     = "Nats-Stream-Ack"
+	HeaderStreamCancel  = "Nats-Stream-Cancel"
+)
+
+var (
+	ErrStreamCanceled = errors.New("nats: reply stream canceled by requester")
+	ErrStreamStalled  = errors.New("nats: reply stream stalled waiting for requester")
+	ErrStreamClosed   = errors.New("nats: reply stream closed")
+	ErrStreamIdle     = errors.New("nats: reply stream idle timeout")
+)
+
+type streamRequestOptions struct {
+	window int
+	idle   time.Duration
+	codec  Codec
+}
+
+type StreamRequestOption func(options *streamRequestOptions)
+
+// WithStreamWindow 未确认分块的上限，应答方超出时等待，默认16
+func WithStreamWindow(window int) StreamRequestOption {
+	return func(options *streamRequestOptions) {
+		options.window = window
+	}
+}
+
+// WithStreamIdleTimeout 两个分块之间的最长间隔，默认5秒，为0时只受ctx限制
+func WithStreamIdleTimeout(idle time.Duration) StreamRequestOption {
+	return func(options *streamRequestOptions) {
+		options.idle = idle
+	}
+}
+
+// WithStreamRequestCodec 请求与分块使用的编解码器，默认为helper的编解码器
+func WithStreamRequestCodec(codec Codec) StreamRequestOption {
+	return func(options *streamRequestOptions) {
+		options.codec = codec
+	}
+}
+
+// StreamReader 流式应答的请求方，通过Next迭代或Chan消费分块
+type StreamReader[T any] struct {
+	helper *NatsHelper
+	ctx    context.Context
+	cancel context.CancelFunc
+	opt    *streamRequestOptions
+	sub    *nats.Subscription
+	msgs   chan *nats.Msg
+
+	seq     uint64
+	acked   uint64
+	control string
+	msg     *nats.Msg
+	value   *T
+	err     error
+	done    bool
+	once    sync.Once
+}
+
+// RequestStream 发送流式请求，应答在ctx结束前消费完毕，使用后需要Close
+// 应答方不支持流式应答时，其单条应答视为只有一个分块的流
+func RequestStream[T any](ctx context.Context, helper *NatsHelper, subject string, v any, option ...StreamRequestOption) (*StreamReader[T], error) {
+	opt := &streamRequestOptions{window: 16, idle: time.Second * 5}
+	for _, o := range option {
+		o(opt)
+	}
+	if opt.window <= 0 {
+		return nil, errors.New("stream window must be positive")
+	}
+	if opt.codec == nil {
+		opt.codec = helper.Codec()
+	}
+	msg, err := EncodeMsg(opt.codec, subject, v)
+	if err != nil {
+		return nil, err
+	}
+	msg.Header.Set(HeaderStreamWindow, strconv.Itoa(opt.window))
+	if err := helper.checkSchemaOut(msg); err != nil {
+		return nil, err
+	}
+	if err := helper.checkOut(msg); err != nil {
+		return nil, err
+	}
+	// 窗口之外还有结束标记
+	msgs := make(chan *nats.Msg, opt.window+1)
+	msg.Reply = helper.Nc.NewRespInbox()
+	sub, err := helper.Nc.ChanSubscribe(msg.Reply, msgs)
+	if err != nil {
+		return nil, err
+	}
+	if err := helper.Nc.PublishMsg(msg); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+	r := &StreamReader[T]{helper: helper, opt: opt, sub: sub, msgs: msgs}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	return r, nil
+}
+
+// Next 等待下一个分块，流结束或出错时返回false，此时通过Err获取错误
+func (r *StreamReader[T]) Next() bool {
+	if r.done {
+		return false
+	}
+	var idle <-chan time.Time
+	if r.opt.idle > 0 {
+		timer := time.NewTimer(r.opt.idle)
+		defer timer.Stop()
+		idle = timer.C
+	}
+	select {
+	case <-r.ctx.Done():
+		return r.fail(r.ctx.Err())
+	case <-idle:
+		return r.fail(nats.ErrTimeout)
+	case msg := <-r.msgs:
+		return r.receive(msg)
+	}
+}
+
+func (r *StreamReader[T]) receive(msg *nats.Msg) bool {
+	if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+		return r.fail(nats.ErrNoResponders)
+	}
+	seqHeader := msg.Header.Get(HeaderStreamSeq)
+	if seqHeader == "" {
+		// 不支持流式应答的对端，或在进入流式处理前就返回的错误
+		r.done = true
+		if err := ServiceError(msg); err != nil {
+			r.err = err
+			return false
+		}
+		return r.decode(msg)
+	}
+	seq, err := strconv.ParseUint(seqHeader, 10, 64)
+	if err != nil || seq != r.seq+1 {
+		return r.fail(fmt.Errorf("nats: reply stream out of order, expect %d, got %s", r.seq+1, seqHeader))
+	}
+	r.seq = seq
+	r.control = msg.Header.Get(HeaderStreamControl)
+	if msg.Header.Get(HeaderStreamEnd) != "" {
+		r.done = true
+		r.err = ServiceError(msg)
+		r.Close()
+		return false
+	}
+	if !r.decode(msg) {
+		return false
+	}
+	// 消费过半窗口后补充额度，避免每个分块都确认
+	if r.seq-r.acked >= uint64(r.opt.window+1)/2 {
+		r.sendControl(HeaderStreamAck, strconv.FormatUint(r.seq, 10))
+		r.acked = r.seq
+	}
+	return true
+}
+
+func (r *StreamReader[T]) decode(msg *nats.Msg) bool {
+	if IsClaimCheck(msg) {
+		if err := r.helper.resolveClaimCheck(msg); err != nil {
+			return r.fail(err)
+		}
+	}
+	var value T
+	if err := DecodeMsg(msg, &value, r.opt.codec); err != nil {
+		return r.fail(err)
+	}
+	r.msg, r.value = msg, &value
+	return true
+}
+
+func (r *StreamReader[T]) fail(err error) bool {
+	r.err = err
+	r.Close()
+	return false
+}
+
+func (r *StreamReader[T]) sendControl(header string, value string) {
+	if r.control == "" {
+		return
+	}
+	msg := nats.NewMsg(r.control)
+	msg.Header.Set(header, value)
+	if err := r.helper.Nc.PublishMsg(msg); err != nil {
+		klog.Warningf("failed to send reply stream control: %v", err)
+	}
+}
+
+// Value 当前分块解码后的值
+func (r *StreamReader[T]) Value() *T {
+	return r.value
+}
+
+// Msg 当前分块的原始消息
+func (r *StreamReader[T]) Msg() *nats.Msg {
+	return r.msg
+}
+
+// Err 流结束的原因，正常结束时为nil，应答方返回的错误为*ServiceErr
+func (r *StreamReader[T]) Err() error {
+	return r.err
+}
+
+// Close 停止接收，流未结束时通知应答方取消
+func (r *StreamReader[T]) Close() {
+	r.once.Do(func() {
+		if !r.done {
+			r.done = true
+			r.sendControl(HeaderStreamCancel, "true")
+		}
+		_ = r.sub.Unsubscribe()
+		r.cancel()
+	})
+}
+
+// Chan 在后台迭代并通过通道传递分块，出错时最后一个元素携带错误，结束后关闭通道与流
+// 调用Chan后不应再调用Next，调用方需读取到通道关闭
+func (r *StreamReader[T]) Chan() <-chan Reply[T] {
+	ch := make(chan Reply[T])
+	go func() {
+		defer close(ch)
+		defer r.Close()
+		for r.Next() {
+			select {
+			case ch <- Reply[T]{Msg: r.msg, Value: r.value}:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		if r.err != nil {
+			ch <- Reply[T]{Err: r.err}
+		}
+	}()
+	return ch
+}
+
+// StreamHandler 流式应答处理器，返回的错误作为错误尾部发送，*ServiceErr保留错误码，其他错误为500
+type StreamHandler func(ctx context.Context, req *nats.Msg, w *StreamWriter) error
+
+type streamReplyOptions struct {
+	codec Codec
+	stall time.Duration
+	idle  time.Duration
+}
+
+type StreamReplyOption func(options *streamReplyOptions)
+
+// WithStreamReplyCodec 分块使用的编解码器，默认与请求的Content-Type一致，没有时为helper的编解码器
+func WithStreamReplyCodec(codec Codec) StreamReplyOption {
+	return func(options *streamReplyOptions) {
+		options.codec = codec
+	}
+}
+
+// WithStreamStallTimeout 窗口用尽后等待请求方确认的最长时间，默认30秒
+func WithStreamStallTimeout(stall time.Duration) StreamReplyOption {
+	return func(options *streamReplyOptions) {
+		options.stall = stall
+	}
+}
+
+// WithStreamWriterIdleTimeout 既没有发送分块也没有收到请求方确认的最长时间，超时后取消ctx，默认1分钟
+// 流在处理器返回后继续运行，不受Timeout等中间件的ctx约束，由该超时回收请求方已消失的流
+func WithStreamWriterIdleTimeout(idle time.Duration) StreamReplyOption {
+	return func(options *streamReplyOptions) {
+		options.idle = idle
+	}
+}
+
+// StreamWriter 流式应答的应答方
+type StreamWriter struct {
+	helper *NatsHelper
+	req    *nats.Msg
+	opt    *streamReplyOptions
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   *time.Timer
+	window uint64
+	seq    uint64
+	acked  atomic.Uint64
+	credit chan struct{}
+	sub    *nats.Subscription
+	closed bool
+}
+
+// NewStreamWriter 为请求创建流式应答，请求方取消或空闲超时时ctx随之取消
+// 请求没有携带窗口时不做流量控制
+func NewStreamWriter(ctx context.Context, helper *NatsHelper, req *nats.Msg, option ...StreamReplyOption) (*StreamWriter, error) {
+	if req.Reply == "" {
+		return nil, errors.New("nats: message is not a request")
+	}
+	opt := &streamReplyOptions{stall: time.Second * 30, idle: time.Minute}
+	for _, o := range option {
+		o(opt)
+	}
+	if opt.codec == nil {
+		opt.codec = helper.Codec()
+		if contentType := req.Header.Get(HeaderContentType); contentType != "" {
+			if codec, err := CodecByContentType(contentType); err == nil {
+				opt.codec = codec
+			}
+		}
+	}
+	window, _ := strconv.ParseUint(req.Header.Get(HeaderStreamWindow), 10, 64)
+	w := &StreamWriter{helper: helper, req: req, opt: opt, window: window, credit: make(chan struct{}, 1)}
+	w.ctx, w.cancel = context.WithCancelCause(ctx)
+	sub, err := helper.Nc.Subscribe(helper.Nc.NewRespInbox(), w.onControl)
+	if err != nil {
+		w.cancel(nil)
+		return nil, err
+	}
+	w.sub = sub
+	if opt.idle > 0 {
+		w.idle = time.AfterFunc(opt.idle, func() {
+			w.cancel(ErrStreamIdle)
+		})
+	}
+	return w, nil
+}
+
+func (w *StreamWriter) touch() {
+	if w.idle != nil {
+		w.idle.Reset(w.opt.idle)
+	}
+}
+
+func (w *StreamWriter) onControl(msg *nats.Msg) {
+	w.touch()
+	if msg.Header.Get(HeaderStreamCancel) != "" {
+		w.cancel(ErrStreamCanceled)
+		return
+	}
+	ack, err := strconv.ParseUint(msg.Header.Get(HeaderStreamAck), 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		acked := w.acked.Load()
+		if ack <= acked || w.acked.CompareAndSwap(acked, ack) {
+			break
+		}
+	}
+	select {
+	case w.credit <- struct{}{}:
+	default:
+	}
+}
+
+// Context 请求方取消或应答结束时取消
+func (w *StreamWriter) Context() context.Context {
+	return w.ctx
+}
+
+// Send 编码并发送一个分块
+func (w *StreamWriter) Send(v any) error {
+	msg, err := EncodeMsg(w.opt.codec, w.req.Reply, v)
+	if err != nil {
+		return err
+	}
+	return w.SendMsg(msg)
+}
+
+// SendMsg 发送一个分块，窗口用尽时等待请求方确认
+func (w *StreamWriter) SendMsg(msg *nats.Msg) error {
+	if w.closed {
+		return ErrStreamClosed
+	}
+	if err := w.waitCredit(); err != nil {
+		return err
+	}
+	msg.Subject = w.req.Reply
+	if err := w.helper.checkOut(msg); err != nil {
+		return err
+	}
+	return w.publish(msg)
+}
+
+func (w *StreamWriter) waitCredit() error {
+	var stall <-chan time.Time
+	for w.window > 0 && w.seq-w.acked.Load() >= w.window {
+		if stall == nil {
+			timer := time.NewTimer(w.opt.stall)
+			defer timer.Stop()
+			stall = timer.C
+		}
+		select {
+		case <-w.ctx.Done():
+			return w.ctxErr()
+		case <-stall:
+			return ErrStreamStalled
+		case <-w.credit:
+		}
+	}
+	return w.ctxErr()
+}
+
+func (w *StreamWriter) ctxErr() error {
+	if w.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(w.ctx)
+}
+
+func (w *StreamWriter) publish(msg *nats.Msg) error {
+	w.touch()
+	w.seq++
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderStreamSeq, strconv.FormatUint(w.seq, 10))
+	msg.Header.Set(HeaderStreamControl, w.sub.Subject)
+	return w.helper.Nc.PublishMsg(msg)
+}
+
+// Close 发送结束标记，err不为nil时作为错误尾部，请求方已取消时不再发送
+func (w *StreamWriter) Close(err error) error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.cancel(nil)
+	defer func() {
+		_ = w.sub.Unsubscribe()
+		if w.idle != nil {
+			w.idle.Stop()
+		}
+	}()
+	if errors.Is(w.ctxErr(), ErrStreamCanceled) {
+		return nil
+	}
+	end := nats.NewMsg(w.req.Reply)
+	end.Header.Set(HeaderStreamEnd, "true")
+	if err != nil {
+		var serviceErr *ServiceErr
+		if !errors.As(err, &serviceErr) {
+			serviceErr = &ServiceErr{Code: http.StatusInternalServerError, Description: err.Error()}
+		}
+		end.Header.Set(HeaderServiceError, serviceErr.Description)
+		end.Header.Set(HeaderServiceErrorCode, strconv.Itoa(serviceErr.Code))
+	}
+	return w.publish(end)
+}
+
+// AddStreamHandler 注册流式应答处理器，每个请求在单独的goroutine中处理，不阻塞后续请求
+// 中间件的ctx在同步处理返回后即取消，流的ctx只保留其中的值，由请求方取消与空闲超时结束
+func (helper *NatsHelper) AddStreamHandler(subject string, handler StreamHandler, option ...StreamReplyOption) error {
+	return helper.subscribe(subject, func(ctx context.Context, msg *nats.Msg) {
+		w, err := NewStreamWriter(context.WithoutCancel(ctx), helper, msg, option...)
+		if err != nil {
+			klog.Errorf("failed to create reply stream for %s: %v", msg.Subject, err)
+			_ = RespondError(msg, http.StatusInternalServerError, "failed to create reply stream")
+			return
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					klog.Errorf("reply stream handler for %s panic: %v", msg.Subject, r)
+					_ = w.Close(fmt.Errorf("panic: %v", r))
+				}
+			}()
+			err := handler(w.Context(), msg, w)
+			if errors.Is(err, ErrStreamCanceled) {
+				err = nil
+			}
+			if closeErr := w.Close(err); closeErr != nil {
+				klog.Warningf("failed to close reply stream for %s: %v", msg.Subject, closeErr)
+			}
+		}()
+	})
+}
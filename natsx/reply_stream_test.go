@@ -0,0 +1,181 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type streamQuery struct {
+	Count int  `json:"count"`
+	Fail  bool `json:"fail"`
+}
+
+type streamRow struct {
+	N int `json:"n"`
+}
+
+func TestRequestStream(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	responder, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(responder.Close)
+	requester, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(requester.Close)
+
+	canceled := make(chan error, 1)
+	err = responder.AddStreamHandler("test.stream.rows", func(ctx context.Context, req *nats.Msg, w *natsx.StreamWriter) error {
+		var query streamQuery
+		if err := natsx.DecodeMsg(req, &query, natsx.JsonCodec{}); err != nil {
+			return &natsx.ServiceErr{Code: http.StatusBadRequest, Description: err.Error()}
+		}
+		for i := 0; i < query.Count; i++ {
+			if err := w.Send(&streamRow{N: i}); err != nil {
+				canceled <- err
+				return err
+			}
+		}
+		if query.Fail {
+			return &natsx.ServiceErr{Code: http.StatusConflict, Description: "snapshot changed"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = responder.Nc.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// 远多于窗口的分块需要流量控制才能完整按序到达
+	r, err := natsx.RequestStream[streamRow](ctx, requester, "test.stream.rows", &streamQuery{Count: 100}, natsx.WithStreamWindow(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r.Next() {
+		if r.Value().N != n {
+			t.Fatalf("expect row %d, got %d", n, r.Value().N)
+		}
+		n++
+	}
+	r.Close()
+	if r.Err() != nil || n != 100 {
+		t.Fatalf("unexpected end of stream after %d rows: %v", n, r.Err())
+	}
+
+	// 错误尾部
+	r, err = natsx.RequestStream[streamRow](ctx, requester, "test.stream.rows", &streamQuery{Count: 3, Fail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []natsx.Reply[streamRow]
+	for reply := range r.Chan() {
+		replies = append(replies, reply)
+	}
+	var serviceErr *natsx.ServiceErr
+	if len(replies) != 4 || !errors.As(replies[3].Err, &serviceErr) || serviceErr.Code != http.StatusConflict {
+		t.Fatalf("unexpected replies: %+v", replies)
+	}
+
+	// 请求方提前关闭时应答方收到取消
+	r, err = natsx.RequestStream[streamRow](ctx, requester, "test.stream.rows", &streamQuery{Count: 1000}, natsx.WithStreamWindow(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Next() {
+		t.Fatal(r.Err())
+	}
+	r.Close()
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, natsx.ErrStreamCanceled) {
+			t.Fatalf("expect canceled, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("responder was not canceled")
+	}
+
+	r, err = natsx.RequestStream[streamRow](ctx, requester, "test.stream.none", &streamQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Next() || !errors.Is(r.Err(), nats.ErrNoResponders) {
+		t.Fatalf("expect no responders, got %v", r.Err())
+	}
+}
+
+func TestRequestStreamMiddleware(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	responder, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(responder.Close)
+	requester, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(requester.Close)
+	// Timeout在同步处理返回后取消ctx，流不应随之取消
+	responder.Use(natsx.Timeout(time.Minute))
+
+	idle := make(chan error, 1)
+	err = responder.AddStreamHandler("test.stream.mw", func(ctx context.Context, req *nats.Msg, w *natsx.StreamWriter) error {
+		var query streamQuery
+		if err := natsx.DecodeMsg(req, &query, natsx.JsonCodec{}); err != nil {
+			return err
+		}
+		for i := 0; i < query.Count; i++ {
+			if err := w.Send(&streamRow{N: i}); err != nil {
+				idle <- err
+				return err
+			}
+		}
+		return nil
+	}, natsx.WithStreamWriterIdleTimeout(time.Millisecond*300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = responder.Nc.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	r, err := natsx.RequestStream[streamRow](ctx, requester, "test.stream.mw", &streamQuery{Count: 50}, natsx.WithStreamWindow(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r.Next() {
+		n++
+	}
+	r.Close()
+	if r.Err() != nil || n != 50 {
+		t.Fatalf("unexpected end of stream after %d rows: %v", n, r.Err())
+	}
+
+	// 请求方不再读取也不取消时，应答方在空闲超时后结束
+	r, err = natsx.RequestStream[streamRow](ctx, requester, "test.stream.mw", &streamQuery{Count: 100}, natsx.WithStreamWindow(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-idle:
+		if !errors.Is(err, natsx.ErrStreamIdle) {
+			t.Fatalf("expect idle timeout, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("responder did not time out")
+	}
+	r.Close()
+}
@@ -0,0 +1,73 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"time"
+)
+
+type requestManyOptions struct {
+	max   int
+	idle  time.Duration
+	codec Codec
+}
+
+type RequestManyOption func(options *requestManyOptions)
+
+// WithMaxReplies 收到n条应答后立即返回，默认不限
+func WithMaxReplies(n int) RequestManyOption {
+	return func(options *requestManyOptions) {
+		options.max = n
+	}
+}
+
+// WithIdleTimeout 超过该时间没有新应答时返回，默认1秒，为0时只受ctx与最大条数限制
+func WithIdleTimeout(idle time.Duration) RequestManyOption {
+	return func(options *requestManyOptions) {
+		options.idle = idle
+	}
+}
+
+// WithRequestCodec 请求使用的编解码器，默认为helper的编解码器
+func WithRequestCodec(codec Codec) RequestManyOption {
+	return func(options *requestManyOptions) {
+		options.codec = codec
+	}
+}
+
+// Reply 单个响应者的应答，处理失败或解码失败时Err不为nil
+type Reply[T any] struct {
+	Msg   *nats.Msg
+	Value *T
+	Err   error
+}
+
+// RequestMany 向所有订阅者发送请求并收集应答，直到达到最大条数、空闲超时或ctx结束
+// 没有任何响应者时返回nats.ErrNoResponders，单个应答的错误记录在Reply.Err中
+func RequestMany[T any](ctx context.Context, helper *NatsHelper, subject string, v any, option ...RequestManyOption) ([]Reply[T], error) {
+	opt := &requestManyOptions{idle: time.Second}
+	for _, o := range option {
+		o(opt)
+	}
+	codec := opt.codec
+	if codec == nil {
+		codec = helper.Codec()
+	}
+	msg, err := EncodeMsg(codec, subject, v)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := helper.collectReplies(ctx, msg, opt.max, opt.idle)
+	replies := make([]Reply[T], 0, len(msgs))
+	for _, m := range msgs {
+		reply := Reply[T]{Msg: m}
+		if reply.Err = ServiceError(m); reply.Err == nil {
+			var value T
+			if reply.Err = DecodeMsg(m, &value, codec); reply.Err == nil {
+				reply.Value = &value
+			}
+		}
+		replies = append(replies, reply)
+	}
+	return replies, err
+}
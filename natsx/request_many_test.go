@@ -0,0 +1,72 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type revision struct {
+	Instance string `json:"instance"`
+	Revision int    `json:"revision"`
+}
+
+func TestRequestMany(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		responder, rev := connect(), i+1
+		err := responder.AddNatsCtxHandler("test.revision", func(ctx context.Context, msg *nats.Msg) {
+			if rev == 3 {
+				_ = natsx.RespondError(msg, http.StatusServiceUnavailable, "not ready")
+				return
+			}
+			reply, _ := natsx.EncodeMsg(natsx.JsonCodec{}, msg.Reply, &revision{Instance: name, Revision: rev})
+			_ = msg.RespondMsg(reply)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = responder.Nc.Flush()
+	}
+
+	helper := connect()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	replies, err := natsx.RequestMany[revision](ctx, helper, "test.revision", struct{}{}, natsx.WithIdleTimeout(time.Millisecond*200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values, failed int
+	for _, reply := range replies {
+		if reply.Err != nil {
+			failed++
+			continue
+		}
+		values++
+	}
+	if values != 2 || failed != 1 {
+		t.Fatalf("unexpected replies: %d values, %d errors", values, failed)
+	}
+
+	replies, err = natsx.RequestMany[revision](ctx, helper, "test.revision", struct{}{}, natsx.WithMaxReplies(1))
+	if err != nil || len(replies) != 1 {
+		t.Fatalf("unexpected replies with max: %d, %v", len(replies), err)
+	}
+
+	if _, err := natsx.RequestMany[revision](ctx, helper, "test.nobody", struct{}{}); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected no responders, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package natsx
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"k8s.io/klog/v2"
+	"sync"
+	"time"
+)
+
+// ErrScheduleInFlight 消息已被领取且租约未到期，可能正在发送，无法取消
+var ErrScheduleInFlight = errors.New("natsx: scheduled message is in flight")
+
+// ScheduledMsg 待定时发送的消息
+type ScheduledMsg struct {
+	Id      string              `json:"id"`
+	Subject string              `json:"subject"`
+	Header  map[string][]string `json:"header,omitempty"`
+	Data    []byte              `json:"data,omitempty"`
+	At      time.Time           `json:"at"`
+	// LeaseUntil 被某个副本领取后，在此时间前不会被其他副本领取
+	LeaseUntil time.Time `json:"lease_until,omitempty"`
+}
+
+// ScheduleStore 定时消息的持久化存储
+type ScheduleStore interface {
+	Add(ctx context.Context, msg *ScheduledMsg) error
+	// Cancel 取消尚未发送的消息，消息不存在时返回false，已被领取且租约未到期时返回ErrScheduleInFlight
+	Cancel(ctx context.Context, id string) (bool, error)
+	// Claim 领取已到期的消息，领取后lease时间内其他副本无法领取
+	Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]*ScheduledMsg, error)
+	// Done 发送完成后删除消息
+	Done(ctx context.Context, id string) error
+}
+
+type schedulerOptions struct {
+	interval  time.Duration
+	batchSize int
+	lease     time.Duration
+	coreNats  bool
+}
+
+type SchedulerOption func(options *schedulerOptions)
+
+// WithSchedulerInterval 检查到期消息的间隔，决定了发送时间的精度，默认1秒
+func WithSchedulerInterval(interval time.Duration) SchedulerOption {
+	return func(options *schedulerOptions) {
+		options.interval = interval
+	}
+}
+
+func WithSchedulerBatchSize(size int) SchedulerOption {
+	return func(options *schedulerOptions) {
+		options.batchSize = size
+	}
+}
+
+// WithSchedulerLease 领取后的租约时间，副本在发送前崩溃时消息会在租约到期后重新发送，默认30秒
+func WithSchedulerLease(lease time.Duration) SchedulerOption {
+	return func(options *schedulerOptions) {
+		options.lease = lease
+	}
+}
+
+// WithSchedulerCoreNats 经由核心NATS发送，目标主题无需被流覆盖
+// 核心NATS不处理Nats-Msg-Id，副本在发送后、标记完成前崩溃时消息会被重复发送(至少一次)
+func WithSchedulerCoreNats() SchedulerOption {
+	return func(options *schedulerOptions) {
+		options.coreNats = true
+	}
+}
+
+// Scheduler 定时发送消息，多个副本可共享同一个存储，每条消息只会被一个副本领取
+// 默认经由JetStream发送并等待确认，目标主题需已被流覆盖
+// 发送时以消息ID作为Nats-Msg-Id，副本崩溃导致的重发会在流的去重窗口内被丢弃
+type Scheduler struct {
+	helper *NatsHelper
+	store  ScheduleStore
+	opt    *schedulerOptions
+
+	stopOnce sync.Once
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewScheduler(helper *NatsHelper, store ScheduleStore, option ...SchedulerOption) *Scheduler {
+	opt := &schedulerOptions{
+		interval:  time.Second,
+		batchSize: 100,
+		lease:     time.Second * 30,
+	}
+	for _, o := range option {
+		o(opt)
+	}
+	return &Scheduler{helper: helper, store: store, opt: opt}
+}
+
+// PublishAt 在at时间编码发送v，返回可用于取消的消息ID
+func (s *Scheduler) PublishAt(ctx context.Context, subject string, v any, at time.Time, codec ...Codec) (string, error) {
+	msg, err := EncodeMsg(s.helper.pickCodec(codec), subject, v)
+	if err != nil {
+		return "", err
+	}
+	return s.ScheduleMsg(ctx, msg, at)
+}
+
+// PublishAfter 在delay之后编码发送v
+func (s *Scheduler) PublishAfter(ctx context.Context, subject string, v any, delay time.Duration, codec ...Codec) (string, error) {
+	return s.PublishAt(ctx, subject, v, time.Now().Add(delay), codec...)
+}
+
+// ScheduleMsg 在at时间发送msg，schema校验在此时进行
+func (s *Scheduler) ScheduleMsg(ctx context.Context, msg *nats.Msg, at time.Time) (string, error) {
+	if err := s.helper.checkSchemaOut(msg); err != nil {
+		return "", err
+	}
+	scheduled := &ScheduledMsg{Id: nuid.Next(), Subject: msg.Subject, Header: msg.Header, Data: msg.Data, At: at}
+	if err := s.store.Add(ctx, scheduled); err != nil {
+		return "", err
+	}
+	return scheduled.Id, nil
+}
+
+// Cancel 取消尚未发送的消息，已发送或不存在时返回false，正在发送时返回ErrScheduleInFlight
+func (s *Scheduler) Cancel(ctx context.Context, id string) (bool, error) {
+	return s.store.Cancel(ctx, id)
+}
+
+// Start 启动后台发送协程，会在helper.Close时停止
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.helper.addCloser(s.Stop)
+	go s.run(ctx)
+}
+
+// Stop 停止发送并等待当前批次完成
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		if s.cancel == nil {
+			return
+		}
+		s.cancel()
+		<-s.done
+	})
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	defer close(s.done)
+	klog.Info("nats scheduler started")
+	for {
+		n, err := s.RunOnce(ctx)
+		if err != nil {
+			klog.Errorf("nats scheduler: %v", err)
+		}
+		wait := s.opt.interval
+		if err == nil && n >= s.opt.batchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			klog.Info("nats scheduler stopped")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RunOnce 领取并发送一批到期消息，返回领取的条数
+func (s *Scheduler) RunOnce(ctx context.Context) (int, error) {
+	msgs, err := s.store.Claim(ctx, time.Now(), s.opt.batchSize, s.opt.lease)
+	if err != nil {
+		return 0, err
+	}
+	for _, scheduled := range msgs {
+		if err := s.publish(ctx, scheduled); err != nil {
+			// 租约到期后会被重新领取
+			klog.Warningf("nats scheduler: failed to publish %s to %s: %v", scheduled.Id, scheduled.Subject, err)
+			continue
+		}
+		if err := s.store.Done(ctx, scheduled.Id); err != nil {
+			klog.Errorf("nats scheduler: failed to remove %s: %v", scheduled.Id, err)
+		}
+	}
+	return len(msgs), nil
+}
+
+func (s *Scheduler) publish(ctx context.Context, scheduled *ScheduledMsg) error {
+	msg := nats.NewMsg(scheduled.Subject)
+	msg.Data = scheduled.Data
+	for k, v := range scheduled.Header {
+		msg.Header[k] = v
+	}
+	msg.Header.Set(nats.MsgIdHdr, scheduled.Id)
+	if s.opt.coreNats {
+		return s.helper.publishMsg(msg)
+	}
+	if err := s.helper.checkOut(msg); err != nil {
+		return err
+	}
+	_, err := s.helper.Js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+// KVScheduleStore 基于JetStream KV桶的存储，领取时需遍历所有键，适用于数量不多的场景
+type KVScheduleStore struct {
+	kv *KV[ScheduledMsg]
+}
+
+// NewKVScheduleStore 绑定或创建存储桶
+func NewKVScheduleStore(helper *NatsHelper, bucket string) (*KVScheduleStore, error) {
+	kv, err := NewKV[ScheduledMsg](helper, &nats.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "natsx scheduled messages",
+		Storage:     nats.FileStorage,
+	}, JsonCodec{})
+	if err != nil {
+		return nil, err
+	}
+	return &KVScheduleStore{kv: kv}, nil
+}
+
+// kvKey 消息ID由nuid生成，仍做编码以兼容自定义ID
+func (s *KVScheduleStore) kvKey(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func (s *KVScheduleStore) Add(_ context.Context, msg *ScheduledMsg) error {
+	_, err := s.kv.Create(s.kvKey(msg.Id), *msg)
+	return err
+}
+
+func (s *KVScheduleStore) Cancel(_ context.Context, id string) (bool, error) {
+	entry, err := s.kv.Get(s.kvKey(id))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if entry.Value.LeaseUntil.After(time.Now()) {
+		return false, ErrScheduleInFlight
+	}
+	if err := s.kv.Delete(entry.Key, nats.LastRevision(entry.Revision)); err != nil {
+		if errors.Is(err, nats.ErrKeyExists) {
+			// 在读取后被领取或已发送
+			return false, ErrScheduleInFlight
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *KVScheduleStore) Claim(_ context.Context, now time.Time, limit int, lease time.Duration) ([]*ScheduledMsg, error) {
+	keys, err := s.kv.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*ScheduledMsg
+	for _, key := range keys {
+		if len(msgs) >= limit {
+			break
+		}
+		entry, err := s.kv.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msg := entry.Value
+		if msg.At.After(now) || msg.LeaseUntil.After(now) {
+			continue
+		}
+		msg.LeaseUntil = now.Add(lease)
+		// 以版本号保证只有一个副本领取成功
+		if _, err := s.kv.Update(key, msg, entry.Revision); err != nil {
+			if errors.Is(err, nats.ErrKeyExists) {
+				continue
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+func (s *KVScheduleStore) Done(_ context.Context, id string) error {
+	return s.kv.Store.Purge(s.kvKey(id))
+}
@@ -0,0 +1,125 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	connect := func() *natsx.NatsHelper {
+		helper, err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(helper.Close)
+		return helper
+	}
+	var lock sync.Mutex
+	received := make(map[string]int)
+	subscriber := connect()
+	// 默认经由JetStream发送，目标主题需被流覆盖
+	if _, err := subscriber.Js.AddStream(&nats.StreamConfig{Name: "SCHEDULE", Subjects: []string{"test.schedule.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := subscriber.AddNatsHandler("test.schedule.>", func(msg *nats.Msg) {
+		lock.Lock()
+		defer lock.Unlock()
+		received[string(msg.Data)]++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = subscriber.Nc.Flush()
+
+	// 两个副本共享同一个存储
+	var schedulers []*natsx.Scheduler
+	for i := 0; i < 2; i++ {
+		helper := connect()
+		store, err := natsx.NewKVScheduleStore(helper, "test_schedule")
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedulers = append(schedulers, natsx.NewScheduler(helper, store, natsx.WithSchedulerInterval(time.Millisecond*20)))
+	}
+	ctx := context.Background()
+	if _, err := schedulers[0].PublishAt(ctx, "test.schedule.now", "now", time.Now().Add(-time.Second), natsx.RawCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	laterAt := time.Now().Add(time.Millisecond * 500)
+	if _, err := schedulers[0].PublishAt(ctx, "test.schedule.later", "later", laterAt, natsx.RawCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := schedulers[1].PublishAfter(ctx, "test.schedule.cancelled", "cancelled", time.Millisecond*200, natsx.RawCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := schedulers[0].Cancel(ctx, id); !ok || err != nil {
+		t.Fatalf("failed to cancel: %v, %v", ok, err)
+	}
+	if ok, _ := schedulers[0].Cancel(ctx, id); ok {
+		t.Fatal("cancel twice should return false")
+	}
+	for _, scheduler := range schedulers {
+		scheduler.Start()
+	}
+	count := func(data string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return received[data]
+	}
+
+	waitFor(t, func() bool { return count("now") == 1 })
+	if time.Now().Before(laterAt) && count("later") != 0 {
+		t.Fatal("message delivered before due time")
+	}
+	waitFor(t, func() bool { return count("later") == 1 })
+	if time.Now().Before(laterAt) {
+		t.Fatal("message delivered before due time")
+	}
+	// 已发送的消息不会被再次领取
+	for _, scheduler := range schedulers {
+		scheduler.Stop()
+		if n, err := scheduler.RunOnce(ctx); n != 0 || err != nil {
+			t.Fatalf("unexpected claim after delivery: %d, %v", n, err)
+		}
+	}
+	_ = subscriber.Nc.Flush()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 2 || received["now"] != 1 || received["later"] != 1 {
+		t.Fatalf("each message should be delivered once: %v", received)
+	}
+}
+
+func TestKVScheduleStoreInFlight(t *testing.T) {
+	helper := natsxtest.New(t)
+	store, err := natsx.NewKVScheduleStore(helper, "test_schedule_in_flight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	if err := store.Add(ctx, &natsx.ScheduledMsg{Id: "due", Subject: "test.schedule.due", At: now.Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := store.Claim(ctx, now, 10, time.Minute); err != nil || len(msgs) != 1 {
+		t.Fatalf("unexpected claimed messages: %+v, %v", msgs, err)
+	}
+	// 租约内可能正在发送，无法取消
+	if ok, err := store.Cancel(ctx, "due"); ok || !errors.Is(err, natsx.ErrScheduleInFlight) {
+		t.Fatalf("claimed message should not be cancelled: %v, %v", ok, err)
+	}
+	if err := store.Done(ctx, "due"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Cancel(ctx, "due"); ok || err != nil {
+		t.Fatalf("sent message should not be cancelled: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,208 @@
+package natsx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"strconv"
+	"strings"
+)
+
+// HeaderSchemaVersion 消息体的schema版本
+const HeaderSchemaVersion = "Nats-Schema-Version"
+
+// Upcaster 将消息体从某个版本转换到下一个版本
+type Upcaster func(data []byte) ([]byte, error)
+
+// Validator 由TypeSchema的类型实现，用于解码后的额外校验
+type Validator interface {
+	Validate() error
+}
+
+// Schema 主题的消息体约束，只校验JSON消息
+type Schema struct {
+	version   int
+	validate  func(data []byte) error
+	upcasters map[int]Upcaster
+}
+
+// TypeSchema 以Go类型作为schema，消息体需能严格解码为T(不允许未知字段)
+// *T实现Validator时还会调用其Validate
+func TypeSchema[T any](version int) *Schema {
+	return &Schema{version: version, validate: func(data []byte) error {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		var v T
+		if err := decoder.Decode(&v); err != nil {
+			return err
+		}
+		if validator, ok := any(&v).(Validator); ok {
+			return validator.Validate()
+		}
+		return nil
+	}}
+}
+
+// JSONSchema 以JSON Schema作为schema
+func JSONSchema(version int, schema string) (*Schema, error) {
+	compiled, err := jsonschema.CompileString(fmt.Sprintf("natsx-schema-v%d.json", version), schema)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{version: version, validate: func(data []byte) error {
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		return compiled.Validate(v)
+	}}, nil
+}
+
+// Upcast 注册从版本from到from+1的转换，接收到旧版本消息时逐级转换到当前版本
+func (s *Schema) Upcast(from int, upcaster Upcaster) *Schema {
+	if s.upcasters == nil {
+		s.upcasters = make(map[int]Upcaster)
+	}
+	s.upcasters[from] = upcaster
+	return s
+}
+
+// Version 当前版本
+func (s *Schema) Version() int {
+	return s.version
+}
+
+// Validate 校验当前版本的消息体
+func (s *Schema) Validate(data []byte) error {
+	return s.validate(data)
+}
+
+func (s *Schema) upcast(version int, data []byte) ([]byte, error) {
+	for ; version < s.version; version++ {
+		upcaster, ok := s.upcasters[version]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster from version %d", version)
+		}
+		var err error
+		if data, err = upcaster(data); err != nil {
+			return nil, fmt.Errorf("failed to upcast from version %d: %w", version, err)
+		}
+	}
+	return data, nil
+}
+
+// SchemaError 消息体不符合主题的schema
+type SchemaError struct {
+	Subject string
+	Version int
+	Err     error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("schema validation failed for %s (version %d): %v", e.Subject, e.Version, e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+type subjectSchema struct {
+	pattern string
+	schema  *Schema
+}
+
+// RegisterSchema 为匹配pattern(可含通配符)的主题注册schema，多个匹配时使用先注册的
+// 经由helper发送的消息会在发送前校验，经由helper注册的处理器会拒绝不符合的消息
+func (helper *NatsHelper) RegisterSchema(pattern string, schema *Schema) {
+	helper.lock.Lock()
+	defer helper.lock.Unlock()
+	helper.schemas = append(helper.schemas, subjectSchema{pattern: pattern, schema: schema})
+}
+
+func (helper *NatsHelper) schemaFor(subject string) *Schema {
+	helper.lock.RLock()
+	defer helper.lock.RUnlock()
+	for _, s := range helper.schemas {
+		if subjectMatches(s.pattern, subject) {
+			return s.schema
+		}
+	}
+	return nil
+}
+
+// checkSchemaOut 校验待发送的消息，未带版本头时设置为当前版本
+func (helper *NatsHelper) checkSchemaOut(msg *nats.Msg) error {
+	schema := helper.schemaFor(msg.Subject)
+	if schema == nil || !isJsonMsg(msg) {
+		return nil
+	}
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	version := schema.version
+	if v := msg.Header.Get(HeaderSchemaVersion); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version != schema.version {
+			return &SchemaError{Subject: msg.Subject, Version: version,
+				Err: fmt.Errorf("publishing version %q, registered version is %d", v, schema.version)}
+		}
+	}
+	if err := schema.validate(msg.Data); err != nil {
+		return &SchemaError{Subject: msg.Subject, Version: version, Err: err}
+	}
+	msg.Header.Set(HeaderSchemaVersion, strconv.Itoa(version))
+	return nil
+}
+
+// checkSchemaIn 将接收到的旧版本消息转换到当前版本并校验，未带版本头时视为当前版本
+func (helper *NatsHelper) checkSchemaIn(msg *nats.Msg) error {
+	schema := helper.schemaFor(msg.Subject)
+	if schema == nil || !isJsonMsg(msg) {
+		return nil
+	}
+	version := schema.version
+	if v := msg.Header.Get(HeaderSchemaVersion); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			return &SchemaError{Subject: msg.Subject, Err: fmt.Errorf("invalid version header %q", v)}
+		}
+	}
+	if version > schema.version {
+		return &SchemaError{Subject: msg.Subject, Version: version,
+			Err: fmt.Errorf("unsupported version, registered version is %d", schema.version)}
+	}
+	if version < schema.version {
+		data, err := schema.upcast(version, msg.Data)
+		if err != nil {
+			return &SchemaError{Subject: msg.Subject, Version: version, Err: err}
+		}
+		msg.Data = data
+		msg.Header.Set(HeaderSchemaVersion, strconv.Itoa(schema.version))
+	}
+	if err := schema.validate(msg.Data); err != nil {
+		return &SchemaError{Subject: msg.Subject, Version: version, Err: err}
+	}
+	return nil
+}
+
+func isJsonMsg(msg *nats.Msg) bool {
+	contentType := msg.Header.Get(HeaderContentType)
+	return contentType == "" || contentType == ContentTypeJson
+}
+
+// subjectMatches 判断主题是否匹配含*或>通配符的pattern
+func subjectMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,106 @@
+package natsx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+type orderV2 struct {
+	Id     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func (o *orderV2) Validate() error {
+	if o.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+func TestSubjectMatches(t *testing.T) {
+	cases := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{"*.created", "users.created", true},
+	}
+	for _, c := range cases {
+		if subjectMatches(c.pattern, c.subject) != c.match {
+			t.Errorf("subjectMatches(%q, %q) should be %v", c.pattern, c.subject, c.match)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	helper := &NatsHelper{}
+	// v1的金额字段为字符串形式的分
+	helper.RegisterSchema("orders.>", TypeSchema[orderV2](2).Upcast(1, func(data []byte) ([]byte, error) {
+		var v1 struct {
+			Id    string `json:"id"`
+			Cents json.Number
+		}
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		amount, err := v1.Cents.Int64()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(&orderV2{Id: v1.Id, Amount: int(amount)})
+	}))
+
+	msg, _ := EncodeMsg(JsonCodec{}, "orders.created", &orderV2{Id: "1", Amount: 10})
+	if err := helper.checkSchemaOut(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get(HeaderSchemaVersion) != "2" {
+		t.Fatalf("unexpected version header: %q", msg.Header.Get(HeaderSchemaVersion))
+	}
+	invalid, _ := EncodeMsg(JsonCodec{}, "orders.created", map[string]any{"id": "1", "amount": 10, "extra": true})
+	var schemaErr *SchemaError
+	if err := helper.checkSchemaOut(invalid); !errors.As(err, &schemaErr) {
+		t.Fatalf("expected schema error for unknown field, got %v", err)
+	}
+
+	old := nats.NewMsg("orders.created")
+	old.Header.Set(HeaderSchemaVersion, "1")
+	old.Data = []byte(`{"id":"2","Cents":"250"}`)
+	var got *orderV2
+	handler := helper.wrapHandler(func(ctx context.Context, msg *nats.Msg) {
+		got = &orderV2{}
+		_ = json.Unmarshal(msg.Data, got)
+	})
+	handler(old)
+	if got == nil || got.Amount != 250 || old.Header.Get(HeaderSchemaVersion) != "2" {
+		t.Fatalf("upcast failed: %+v", got)
+	}
+
+	got = nil
+	negative := nats.NewMsg("orders.created")
+	negative.Data = []byte(`{"id":"3","amount":-1}`)
+	handler(negative)
+	if got != nil {
+		t.Fatal("handler should not receive invalid message")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := JSONSchema(1, `{"type":"object","required":["id"],"properties":{"id":{"type":"string"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate([]byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate([]byte(`{"id":1}`)); err == nil {
+		t.Fatal("expected validation error")
+	}
+}
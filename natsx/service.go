@@ -0,0 +1,305 @@
+package natsx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EndpointHandler 服务端点处理器，返回的错误会以服务错误头应答并计入统计
+// 返回*ServiceErr时使用其中的错误码，其他错误视为500
+type EndpointHandler func(ctx context.Context, req micro.Request) error
+
+// EndpointErrorStats 端点处理器返回错误的统计，作为STATS中端点的data字段
+type EndpointErrorStats struct {
+	NumHandlerErrors int    `json:"num_handler_errors"`
+	LastHandlerError string `json:"last_handler_error,omitempty"`
+}
+
+// EndpointStatsData 配置了cfg.StatsHandler时STATS中端点的data字段，自定义统计位于custom
+type EndpointStatsData struct {
+	EndpointErrorStats
+	Custom any `json:"custom,omitempty"`
+}
+
+// Service 基于NATS服务API($SRV.PING/$SRV.INFO/$SRV.STATS)的微服务
+type Service struct {
+	micro.Service
+	helper *NatsHelper
+
+	lock   sync.Mutex
+	errors map[string]*EndpointErrorStats
+}
+
+// ServiceGroup 端点分组，通常用于版本前缀，如svc.Group("orders.v1")
+type ServiceGroup struct {
+	svc   *Service
+	group micro.Group
+}
+
+// NewService 注册服务，cfg.Version需为SemVer格式
+// 服务会在helper.Close时停止
+func NewService(helper *NatsHelper, cfg micro.Config) (*Service, error) {
+	svc := &Service{helper: helper, errors: make(map[string]*EndpointErrorStats)}
+	userStats := cfg.StatsHandler
+	cfg.StatsHandler = func(endpoint *micro.Endpoint) interface{} {
+		if userStats != nil {
+			return EndpointStatsData{EndpointErrorStats: svc.endpointErrors(endpoint.Subject), Custom: userStats(endpoint)}
+		}
+		return svc.endpointErrors(endpoint.Subject)
+	}
+	var err error
+	if svc.Service, err = micro.AddService(helper.Nc, cfg); err != nil {
+		return nil, err
+	}
+	helper.addCloser(func() {
+		if err := svc.Stop(); err != nil {
+			utils.LogError(fmt.Errorf("failed to stop service %s: %w", cfg.Name, err))
+		}
+	})
+	return svc, nil
+}
+
+// Group 创建端点分组
+func (svc *Service) Group(name string) *ServiceGroup {
+	return &ServiceGroup{svc: svc, group: svc.AddGroup(name)}
+}
+
+// AddEndpoint 添加端点，主题默认为name
+func (svc *Service) AddEndpoint(name string, handler EndpointHandler, opts ...micro.EndpointOpt) error {
+	return svc.Service.AddEndpoint(name, svc.wrap(name, handler), opts...)
+}
+
+func (g *ServiceGroup) Group(name string) *ServiceGroup {
+	return &ServiceGroup{svc: g.svc, group: g.group.AddGroup(name)}
+}
+
+// AddEndpoint 添加端点，主题为分组前缀加name
+func (g *ServiceGroup) AddEndpoint(name string, handler EndpointHandler, opts ...micro.EndpointOpt) error {
+	return g.group.AddEndpoint(name, g.svc.wrap(name, handler), opts...)
+}
+
+// AddTypedEndpoint 添加自动编解码的端点，请求与应答使用helper的编解码器
+func AddTypedEndpoint[Req, Resp any](svc *Service, name string, handler func(ctx context.Context, req *Req) (*Resp, error), opts ...micro.EndpointOpt) error {
+	return svc.AddEndpoint(name, typedEndpoint(svc.helper, handler), opts...)
+}
+
+// AddTypedGroupEndpoint 与AddTypedEndpoint相同，添加到分组下
+func AddTypedGroupEndpoint[Req, Resp any](g *ServiceGroup, name string, handler func(ctx context.Context, req *Req) (*Resp, error), opts ...micro.EndpointOpt) error {
+	return g.AddEndpoint(name, typedEndpoint(g.svc.helper, handler), opts...)
+}
+
+func typedEndpoint[Req, Resp any](helper *NatsHelper, handler func(ctx context.Context, req *Req) (*Resp, error)) EndpointHandler {
+	return func(ctx context.Context, req micro.Request) error {
+		codec := helper.Codec()
+		if contentType := req.Headers().Get(HeaderContentType); contentType != "" {
+			var err error
+			if codec, err = CodecByContentType(contentType); err != nil {
+				return &ServiceErr{Code: http.StatusUnsupportedMediaType, Description: err.Error()}
+			}
+		}
+		var input Req
+		if err := codec.Decode(req.Subject(), req.Data(), &input); err != nil {
+			return &ServiceErr{Code: http.StatusBadRequest, Description: fmt.Sprintf("failed to decode request: %v", err)}
+		}
+		output, err := handler(ctx, &input)
+		if err != nil {
+			return err
+		}
+		data, err := codec.Encode(req.Subject(), output)
+		if err != nil {
+			return err
+		}
+		return req.Respond(data, micro.WithHeaders(micro.Headers{HeaderContentType: []string{codec.ContentType()}}))
+	}
+}
+
+// endpointRequest 中间件处理后的请求，消息体与消息头来自已取回ClaimCheck的消息，应答仍经由原请求发送
+type endpointRequest struct {
+	micro.Request
+	msg *nats.Msg
+}
+
+func (r *endpointRequest) Data() []byte {
+	return r.msg.Data
+}
+
+func (r *endpointRequest) Headers() micro.Headers {
+	return micro.Headers(r.msg.Header)
+}
+
+type endpointCallKey struct{}
+
+// endpointCall 单次请求在中间件链内外传递的状态
+type endpointCall struct {
+	req     micro.Request
+	handled bool
+	err     error
+}
+
+// wrap 为端点处理器提供追踪、崩溃恢复与错误统计，并与订阅一样经过helper的中间件、ClaimCheck与schema校验
+// 中间件处理的是不带Reply的请求副本，应答统一由wrap经原请求发送
+func (svc *Service) wrap(name string, handler EndpointHandler) micro.Handler {
+	tracer := otel.Tracer(meterName)
+	chain := svc.helper.applyMiddlewares(func(ctx context.Context, msg *nats.Msg) {
+		call := ctx.Value(endpointCallKey{}).(*endpointCall)
+		call.handled = true
+		if err := svc.helper.prepareIn(ctx, msg); err != nil {
+			call.err = err
+			return
+		}
+		call.err = func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					stack := make([]byte, 4<<10) // default stack length: 4kb
+					length := runtime.Stack(stack, false)
+					utils.ErrorWithCtx(ctx, fmt.Sprintf("[PANIC RECOVER] %v\n%s", r, stack[:length]))
+					err = &ServiceErr{Code: http.StatusInternalServerError, Description: "Internal Server Error"}
+				}
+			}()
+			return handler(ctx, &endpointRequest{Request: call.req, msg: msg})
+		}()
+	})
+	return micro.HandlerFunc(func(req micro.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), HeaderCarrier(req.Headers()))
+		ctx, span := tracer.Start(ctx, "nats service "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "nats"),
+				attribute.String("messaging.destination.name", req.Subject()),
+				attribute.String("service.endpoint", name),
+			))
+		defer span.End()
+
+		call := &endpointCall{req: req}
+		msg := &nats.Msg{Subject: req.Subject(), Header: nats.Header(req.Headers()), Data: req.Data()}
+		chain(context.WithValue(ctx, endpointCallKey{}, call), msg)
+		err := call.err
+		if err == nil && !call.handled {
+			err = &ServiceErr{Code: http.StatusServiceUnavailable, Description: "request dropped by middleware"}
+		}
+		if err == nil {
+			return
+		}
+		svc.recordError(req.Subject(), err)
+		span.SetStatus(codes.Error, err.Error())
+		var serviceErr *ServiceErr
+		if !errors.As(err, &serviceErr) {
+			serviceErr = &ServiceErr{Code: http.StatusInternalServerError, Description: err.Error()}
+		}
+		if err := req.Error(strconv.Itoa(serviceErr.Code), serviceErr.Description, nil); err != nil {
+			utils.ErrorWithCtx(ctx, fmt.Sprintf("failed to respond error: %v", err))
+		}
+	})
+}
+
+func (svc *Service) recordError(subject string, err error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	stats, ok := svc.errors[subject]
+	if !ok {
+		stats = &EndpointErrorStats{}
+		svc.errors[subject] = stats
+	}
+	stats.NumHandlerErrors++
+	stats.LastHandlerError = err.Error()
+}
+
+func (svc *Service) endpointErrors(subject string) EndpointErrorStats {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	if stats, ok := svc.errors[subject]; ok {
+		return *stats
+	}
+	return EndpointErrorStats{}
+}
+
+// DiscoverServices 发现在线的服务实例，name为空时发现所有服务
+// 在ctx结束或idle时间内没有新应答时返回
+func (helper *NatsHelper) DiscoverServices(ctx context.Context, name string, idle time.Duration) ([]micro.Ping, error) {
+	return discover[micro.Ping](ctx, helper, micro.PingVerb, name, idle)
+}
+
+// ServiceInfos 获取服务实例的端点信息
+func (helper *NatsHelper) ServiceInfos(ctx context.Context, name string, idle time.Duration) ([]micro.Info, error) {
+	return discover[micro.Info](ctx, helper, micro.InfoVerb, name, idle)
+}
+
+// ServiceStats 获取服务实例的请求数、错误数与处理耗时
+func (helper *NatsHelper) ServiceStats(ctx context.Context, name string, idle time.Duration) ([]micro.Stats, error) {
+	return discover[micro.Stats](ctx, helper, micro.StatsVerb, name, idle)
+}
+
+func discover[T any](ctx context.Context, helper *NatsHelper, verb micro.Verb, name string, idle time.Duration) ([]T, error) {
+	subject, err := micro.ControlSubject(verb, name, "")
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := helper.collectReplies(ctx, nats.NewMsg(subject), 0, idle)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := make([]T, 0, len(msgs))
+	for _, msg := range msgs {
+		var result T
+		if err := json.Unmarshal(msg.Data, &result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// collectReplies 发送请求并收集多个应答，直到达到max条(max<=0时不限)、idle时间内没有新应答或ctx结束
+func (helper *NatsHelper) collectReplies(ctx context.Context, msg *nats.Msg, max int, idle time.Duration) ([]*nats.Msg, error) {
+	inbox := helper.Nc.NewRespInbox()
+	sub, err := helper.Nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	msg.Reply = inbox
+	if err := helper.publishMsg(msg); err != nil {
+		return nil, err
+	}
+	var replies []*nats.Msg
+	for max <= 0 || len(replies) < max {
+		waitCtx, cancel := ctx, context.CancelFunc(func() {})
+		if idle > 0 {
+			waitCtx, cancel = context.WithTimeout(ctx, idle)
+		}
+		reply, err := sub.NextMsgWithContext(waitCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			// idle超时或ctx到期，返回已收到的应答
+			break
+		}
+		if err != nil {
+			return replies, err
+		}
+		if len(reply.Data) == 0 && reply.Header.Get("Status") == "503" {
+			// 服务端在没有订阅者时返回的状态消息
+			return replies, nats.ErrNoResponders
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
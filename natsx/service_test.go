@@ -0,0 +1,201 @@
+package natsx_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestService(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	server, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	svc, err := natsx.NewService(server, micro.Config{Name: "orders", Version: "1.0.0", Description: "order service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := natsx.AddTypedEndpoint(svc, "echo", func(ctx context.Context, req *codecData) (*codecData, error) {
+		return &codecData{Key: req.Key + "!"}, nil
+	}, micro.WithEndpointSubject("orders.echo")); err != nil {
+		t.Fatal(err)
+	}
+	v1 := svc.Group("orders.v1")
+	if err := v1.AddEndpoint("fail", func(ctx context.Context, req micro.Request) error {
+		return &natsx.ServiceErr{Code: http.StatusBadRequest, Description: "bad order"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.AddEndpoint("boom", func(ctx context.Context, req micro.Request) error {
+		return errors.New("db down")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.AddEndpoint("panic", func(ctx context.Context, req micro.Request) error {
+		panic("oops")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	got, err := natsx.RequestAs[codecData](ctx, client, "orders.echo", &codecData{Key: "k"})
+	if err != nil || got.Key != "k!" {
+		t.Fatalf("unexpected reply: %+v, %v", got, err)
+	}
+	for subject, code := range map[string]int{
+		"orders.v1.fail":  http.StatusBadRequest,
+		"orders.v1.boom":  http.StatusInternalServerError,
+		"orders.v1.panic": http.StatusInternalServerError,
+	} {
+		var serviceErr *natsx.ServiceErr
+		if err := client.RequestJsonCtx(ctx, subject, &codecData{}, &codecData{}); !errors.As(err, &serviceErr) || serviceErr.Code != code {
+			t.Fatalf("%s: expect service error %d, got %v", subject, code, err)
+		}
+	}
+
+	pings, err := client.DiscoverServices(ctx, "", time.Millisecond*200)
+	if err != nil || len(pings) != 1 || pings[0].Name != "orders" || pings[0].Version != "1.0.0" {
+		t.Fatalf("unexpected pings: %+v, %v", pings, err)
+	}
+	infos, err := client.ServiceInfos(ctx, "orders", time.Millisecond*200)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("unexpected infos: %+v, %v", infos, err)
+	}
+	subjects := infos[0].Subjects
+	sort.Strings(subjects)
+	if strings.Join(subjects, ",") != "orders.echo,orders.v1.boom,orders.v1.fail,orders.v1.panic" {
+		t.Fatalf("unexpected subjects: %v", subjects)
+	}
+
+	stats, err := client.ServiceStats(ctx, "orders", time.Millisecond*200)
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("unexpected stats: %+v, %v", stats, err)
+	}
+	for _, endpoint := range stats[0].Endpoints {
+		var errStats natsx.EndpointErrorStats
+		if err := json.Unmarshal(endpoint.Data, &errStats); err != nil {
+			t.Fatal(err)
+		}
+		wantErrors := 1
+		if endpoint.Subject == "orders.echo" {
+			wantErrors = 0
+		}
+		// micro只统计应答发送失败的错误，处理器错误记录在data中
+		if endpoint.NumRequests != 1 || errStats.NumHandlerErrors != wantErrors {
+			t.Fatalf("unexpected stats of %s: %+v, %+v", endpoint.Subject, endpoint, errStats)
+		}
+		if endpoint.Subject == "orders.v1.fail" && !strings.Contains(errStats.LastHandlerError, "bad order") {
+			t.Fatalf("unexpected last error: %s", errStats.LastHandlerError)
+		}
+	}
+
+	if pings, err := client.DiscoverServices(ctx, "missing", time.Millisecond*200); err != nil || len(pings) != 0 {
+		t.Fatalf("unexpected pings of missing service: %+v, %v", pings, err)
+	}
+	// 服务随helper关闭停止
+	server.Close()
+	if pings, err := client.DiscoverServices(ctx, "orders", time.Millisecond*200); err != nil || len(pings) != 0 {
+		t.Fatalf("service should be stopped: %+v, %v", pings, err)
+	}
+}
+
+func TestServiceMiddleware(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	server, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	client, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	obj, err := natsx.NewObjectStore(client, &nats.ObjectStoreConfig{Bucket: "service_claim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.EnableClaimCheck(obj, 64)
+
+	var lock sync.Mutex
+	var seen []string
+	server.Use(func(next natsx.MsgHandler) natsx.MsgHandler {
+		return func(ctx context.Context, msg *nats.Msg) {
+			lock.Lock()
+			seen = append(seen, msg.Subject)
+			lock.Unlock()
+			if msg.Subject == "svc.dropped" {
+				return
+			}
+			next(ctx, msg)
+		}
+	})
+	server.RegisterSchema("svc.>", natsx.TypeSchema[codecData](1))
+	svc, err := natsx.NewService(server, micro.Config{Name: "svc", Version: "1.0.0", StatsHandler: func(endpoint *micro.Endpoint) interface{} {
+		return endpoint.Subject
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"echo", "dropped"} {
+		if err := natsx.AddTypedEndpoint(svc, name, func(ctx context.Context, req *codecData) (*codecData, error) {
+			return req, nil
+		}, micro.WithEndpointSubject("svc."+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	// 超出阈值的请求经ClaimCheck转存，端点收到取回后的消息体
+	key := strings.Repeat("k", 128)
+	got, err := natsx.RequestAs[codecData](ctx, client, "svc.echo", &codecData{Key: key})
+	if err != nil || got.Key != key {
+		t.Fatalf("unexpected reply: %+v, %v", got, err)
+	}
+	var serviceErr *natsx.ServiceErr
+	if err := client.RequestJsonCtx(ctx, "svc.echo", map[string]any{"unknown": 1}, &codecData{}); !errors.As(err, &serviceErr) || serviceErr.Code != http.StatusBadRequest {
+		t.Fatalf("expect schema error, got %v", err)
+	}
+	if err := client.RequestJsonCtx(ctx, "svc.dropped", &codecData{}, &codecData{}); !errors.As(err, &serviceErr) || serviceErr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expect dropped error, got %v", err)
+	}
+	lock.Lock()
+	if strings.Join(seen, ",") != "svc.echo,svc.echo,svc.dropped" {
+		t.Fatalf("unexpected middleware calls: %v", seen)
+	}
+	lock.Unlock()
+
+	stats, err := client.ServiceStats(ctx, "svc", time.Millisecond*200)
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("unexpected stats: %+v, %v", stats, err)
+	}
+	for _, endpoint := range stats[0].Endpoints {
+		var data natsx.EndpointStatsData
+		if err := json.Unmarshal(endpoint.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		// 自定义统计与错误统计同时保留
+		if data.Custom != endpoint.Subject || data.NumHandlerErrors != 1 {
+			t.Fatalf("unexpected stats of %s: %+v", endpoint.Subject, data)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package natsx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"io"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolFileName        = "spool.dat"
+	defaultSpoolMaxBytes = 64 << 20
+	// spoolFlushTimeout 重放后等待服务端确认收到的时间
+	spoolFlushTimeout = time.Second * 5
+)
+
+// ErrSpoolFull 断线期间暂存的消息超过上限，本条消息被丢弃
+var ErrSpoolFull = errors.New("nats publish spool is full")
+
+// SpoolStatus 暂存队列的状态
+type SpoolStatus struct {
+	Depth   int64 `json:"depth"`
+	Bytes   int64 `json:"bytes"`
+	Dropped int64 `json:"dropped"`
+}
+
+type spoolRecord struct {
+	Subject string              `json:"subject"`
+	Header  map[string][]string `json:"header,omitempty"`
+	Data    []byte              `json:"data,omitempty"`
+}
+
+// Spool 断线期间将发送的消息按顺序暂存到本地文件，重连后重放
+// 只暂存没有Reply的普通消息，请求仍会直接失败
+type Spool struct {
+	helper   *NatsHelper
+	path     string
+	maxBytes int64
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	depth   int64
+	dropped atomic.Int64
+	closed  bool
+}
+
+// EnableSpool 为经由helper发送的消息启用本地暂存，maxBytes<=0时为64MB
+// dir中已有的暂存消息会在连接可用时重放，同一目录不能被多个进程同时使用
+func (helper *NatsHelper) EnableSpool(dir string, maxBytes int64) error {
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s := &Spool{helper: helper, path: filepath.Join(dir, spoolFileName), maxBytes: maxBytes}
+	if err := s.open(); err != nil {
+		return err
+	}
+	helper.spool = s
+	helper.addCloser(s.close)
+	if s.depth > 0 {
+		klog.Infof("nats spool: %d messages pending from previous run", s.depth)
+		go s.replay()
+	}
+	return nil
+}
+
+// open 打开暂存文件并统计已有消息，丢弃崩溃时写了一半的记录
+func (s *Spool) open() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		n, _, err := readSpoolRecord(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				klog.Warningf("nats spool: truncating corrupted tail of %s at %d: %v", s.path, valid, err)
+			}
+			break
+		}
+		valid += n
+		s.depth++
+	}
+	if err := file.Truncate(valid); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file, s.size = file, valid
+	return nil
+}
+
+// publish 断线或仍有未重放的消息时暂存，返回false时由调用方直接发送
+func (s *Spool) publish(msg *nats.Msg) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || (s.depth == 0 && s.helper.Nc.IsConnected()) {
+		return false, nil
+	}
+	return true, s.append(msg)
+}
+
+// spoolOnError 连接断开导致发送失败时改为暂存
+func (s *Spool) spoolOnError(msg *nats.Msg, err error) (bool, error) {
+	if !errors.Is(err, nats.ErrReconnectBufExceeded) && !errors.Is(err, nats.ErrConnectionReconnecting) {
+		return false, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false, err
+	}
+	return true, s.append(msg)
+}
+
+func (s *Spool) append(msg *nats.Msg) error {
+	data, err := json.Marshal(&spoolRecord{Subject: msg.Subject, Header: msg.Header, Data: msg.Data})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	if s.size+int64(len(record)) > s.maxBytes {
+		s.dropped.Add(1)
+		return ErrSpoolFull
+	}
+	if _, err := s.file.Write(record); err != nil {
+		// 移除写了一半的记录
+		_ = s.file.Truncate(s.size)
+		_, _ = s.file.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	s.depth++
+	if s.depth == 1 && s.helper.Nc.IsConnected() {
+		// 连接已恢复但重放失败留下的消息，不需要等待下一次重连
+		go s.replay()
+	}
+	return nil
+}
+
+// replay 按顺序重放暂存的消息，期间新发送的消息会排在后面
+// 再次断线时保留未发送的部分
+func (s *Spool) replay() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || s.depth == 0 {
+		return
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		klog.Errorf("nats spool: failed to seek %s: %v", s.path, err)
+		return
+	}
+	reader := bufio.NewReader(s.file)
+	var offset, sent int64
+	for s.helper.Nc.IsConnected() {
+		n, record, err := readSpoolRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			klog.Errorf("nats spool: failed to read %s: %v", s.path, err)
+			break
+		}
+		msg := &nats.Msg{Subject: record.Subject, Header: record.Header, Data: record.Data}
+		if err := s.helper.checkOut(msg); err != nil {
+			klog.Errorf("nats spool: failed to replay message to %s: %v", msg.Subject, err)
+			break
+		}
+		if err := s.helper.Nc.PublishMsg(msg); err != nil {
+			klog.Errorf("nats spool: failed to replay message to %s: %v", msg.Subject, err)
+			break
+		}
+		offset += n
+		sent++
+	}
+	if sent > 0 {
+		// PublishMsg只写入缓冲区，服务端确认收到后才能从文件中移除
+		if err := s.helper.Nc.FlushTimeout(spoolFlushTimeout); err != nil {
+			klog.Errorf("nats spool: failed to flush replayed messages, keeping %d pending: %v", s.depth, err)
+			_, _ = s.file.Seek(s.size, io.SeekStart)
+			return
+		}
+	}
+	if err := s.compact(offset); err != nil {
+		// 无法截断时保留全部记录，已发送的部分会在下次重放时重复发送
+		klog.Errorf("nats spool: failed to compact %s: %v", s.path, err)
+		_, _ = s.file.Seek(s.size, io.SeekStart)
+		return
+	}
+	s.depth -= sent
+	klog.Infof("nats spool: replayed %d messages, %d pending", sent, s.depth)
+}
+
+// compact 移除已发送的前offset字节，剩余部分写入新文件后替换
+func (s *Spool) compact(offset int64) error {
+	if offset == 0 {
+		_, err := s.file.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if offset == s.size {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		s.size = 0
+		_, err := s.file.Seek(0, io.SeekStart)
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(s.file, offset, s.size-offset)); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+	_ = s.file.Close()
+	s.file, s.size = tmp, s.size-offset
+	_, err = s.file.Seek(s.size, io.SeekStart)
+	return err
+}
+
+// syncDir 持久化目录项，使重命名在崩溃后仍然有效
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		klog.Warningf("nats spool: failed to sync dir %s: %v", dir, err)
+	}
+}
+
+func (s *Spool) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.depth > 0 {
+		klog.Warningf("nats spool: %d messages left in %s", s.depth, s.path)
+	}
+	if err := s.file.Close(); err != nil {
+		klog.Errorf("nats spool: failed to close %s: %v", s.path, err)
+	}
+}
+
+// Status 暂存队列的当前状态
+func (s *Spool) Status() SpoolStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SpoolStatus{Depth: s.depth, Bytes: s.size, Dropped: s.dropped.Load()}
+}
+
+func readSpoolRecord(reader io.Reader) (int64, *spoolRecord, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("incomplete record header: %w", err)
+		}
+		return 0, nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, fmt.Errorf("incomplete record: %w", err)
+	}
+	record := &spoolRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return 0, nil, err
+	}
+	return int64(4 + len(data)), record, nil
+}
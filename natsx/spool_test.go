@@ -0,0 +1,99 @@
+package natsx_test
+
+import (
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx/natsxtest"
+	"github.com/nats-io/nats.go"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	storeDir := t.TempDir()
+	s, err := natsxtest.Start(natsxtest.WithStoreDir(storeDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := s.Addr().(*net.TCPAddr).Port
+	cfg := s.Config()
+	cfg.NatsReconnectWait = time.Millisecond * 50
+	cfg.NatsSpoolDir = t.TempDir()
+	cfg.NatsSpoolMaxBytes = 512
+	helper := &natsx.NatsHelper{}
+	if err := helper.Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(helper.Close)
+	// 流保存在存储目录中，重启后继续接收重放的消息
+	if _, err := helper.Js.AddStream(&nats.StreamConfig{Name: "SPOOL", Subjects: []string{"test.spool.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Shutdown()
+	waitFor(t, func() bool { return !helper.Nc.IsConnected() })
+	var spooled int
+	for i := 0; i < 10; i++ {
+		err := helper.PublishJson("test.spool.order", map[string]int{"seq": i})
+		if errors.Is(err, natsx.ErrSpoolFull) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		spooled++
+	}
+	status := helper.Status().Spool
+	if spooled == 0 || spooled == 10 || status.Depth != int64(spooled) || status.Dropped != 1 {
+		t.Fatalf("unexpected spool status after %d messages: %+v", spooled, status)
+	}
+
+	s, err = natsxtest.Start(natsxtest.WithStoreDir(storeDir), natsxtest.WithPort(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Shutdown)
+	waitFor(t, func() bool { return helper.Status().Spool.Depth == 0 })
+	waitFor(t, func() bool {
+		info, err := helper.Js.StreamInfo("SPOOL")
+		return err == nil && info.State.Msgs == uint64(spooled)
+	})
+	first, err := helper.Js.GetMsg("SPOOL", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Data) != `{"seq":0}` {
+		t.Fatalf("unexpected first replayed message: %s", first.Data)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestSpoolOpenError(t *testing.T) {
+	s := natsxtest.NewServer(t)
+	cfg := s.Config()
+	// 暂存目录是一个文件，启用暂存失败
+	cfg.NatsSpoolDir = filepath.Join(t.TempDir(), "spool")
+	if err := os.WriteFile(cfg.NatsSpoolDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	helper := &natsx.NatsHelper{}
+	if err := helper.Open(cfg); err == nil {
+		t.Fatal("expect spool error")
+	}
+	if !helper.Nc.IsClosed() {
+		t.Fatal("connection should be closed when spool fails")
+	}
+}
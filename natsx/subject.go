@@ -0,0 +1,356 @@
+package natsx
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"github.com/TiyaAnlite/FocotServicesCommon/utils"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrSubjectMismatch 主题与模板不匹配
+var ErrSubjectMismatch = errors.New("natsx: subject does not match template")
+
+// ValidateSubjectToken 检查参数值能否作为主题中的单个token
+func ValidateSubjectToken(token string) error {
+	if token == "" {
+		return errors.New("natsx: empty subject token")
+	}
+	if strings.ContainsAny(token, ".*>") || strings.IndexFunc(token, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("natsx: invalid subject token %q", token)
+	}
+	return nil
+}
+
+// SubjectTemplate 主题模板，如orders.{region}.{id}.created，每个参数占据一个完整的token
+type SubjectTemplate struct {
+	template string
+	tokens   []string
+	// names 与tokens一一对应，参数token为参数名，字面量为空
+	names  []string
+	params []string
+}
+
+// ParseSubject 解析主题模板
+func ParseSubject(template string) (*SubjectTemplate, error) {
+	t := &SubjectTemplate{template: template, tokens: strings.Split(template, ".")}
+	t.names = make([]string, len(t.tokens))
+	for i, token := range t.tokens {
+		if strings.HasPrefix(token, "{") && strings.HasSuffix(token, "}") {
+			name := token[1 : len(token)-1]
+			if name == "" || strings.ContainsAny(name, "{}") || slices.Contains(t.params, name) {
+				return nil, fmt.Errorf("natsx: invalid parameter %s in subject template %s", token, template)
+			}
+			t.names[i] = name
+			t.params = append(t.params, name)
+			continue
+		}
+		if strings.ContainsAny(token, "{}") || ValidateSubjectToken(token) != nil {
+			return nil, fmt.Errorf("natsx: invalid token %q in subject template %s", token, template)
+		}
+	}
+	return t, nil
+}
+
+// MustParseSubject 解析失败时panic，用于包级变量
+func MustParseSubject(template string) *SubjectTemplate {
+	t, err := ParseSubject(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *SubjectTemplate) String() string {
+	return t.template
+}
+
+// Params 按出现顺序的参数名
+func (t *SubjectTemplate) Params() []string {
+	return append([]string(nil), t.params...)
+}
+
+// Render 以参数值生成主题，缺少参数或参数值不是合法token时返回错误
+func (t *SubjectTemplate) Render(values map[string]string) (string, error) {
+	return t.render(values, false)
+}
+
+// Format 按参数顺序生成主题，支持字符串、整数、布尔值以及实现了encoding.TextMarshaler或fmt.Stringer的类型
+func (t *SubjectTemplate) Format(args ...any) (string, error) {
+	if len(args) != len(t.params) {
+		return "", fmt.Errorf("natsx: subject template %s expects %d parameters, got %d", t.template, len(t.params), len(args))
+	}
+	values := make(map[string]string, len(args))
+	for i, arg := range args {
+		value, err := formatSubjectToken(reflect.ValueOf(arg))
+		if err != nil {
+			return "", fmt.Errorf("natsx: parameter %s: %w", t.params[i], err)
+		}
+		values[t.params[i]] = value
+	}
+	return t.render(values, false)
+}
+
+// Pattern 所有参数替换为*的订阅主题
+func (t *SubjectTemplate) Pattern() string {
+	subject, _ := t.render(nil, true)
+	return subject
+}
+
+// Filter 给定的参数替换为参数值，其余参数替换为*，用于订阅部分参数
+func (t *SubjectTemplate) Filter(values map[string]string) (string, error) {
+	return t.render(values, true)
+}
+
+func (t *SubjectTemplate) render(values map[string]string, wildcard bool) (string, error) {
+	tokens := make([]string, len(t.tokens))
+	for i, token := range t.tokens {
+		name := t.names[i]
+		if name == "" {
+			tokens[i] = token
+			continue
+		}
+		value, ok := values[name]
+		if !ok && wildcard {
+			tokens[i] = "*"
+			continue
+		}
+		if !ok {
+			return "", fmt.Errorf("natsx: missing parameter %s for subject template %s", name, t.template)
+		}
+		if err := ValidateSubjectToken(value); err != nil {
+			return "", fmt.Errorf("natsx: parameter %s: %w", name, err)
+		}
+		tokens[i] = value
+	}
+	return strings.Join(tokens, "."), nil
+}
+
+// Match 主题是否符合模板
+func (t *SubjectTemplate) Match(subject string) bool {
+	_, err := t.Parse(subject)
+	return err == nil
+}
+
+// Parse 从主题中解析参数值，不匹配时返回ErrSubjectMismatch
+func (t *SubjectTemplate) Parse(subject string) (map[string]string, error) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != len(t.tokens) {
+		return nil, ErrSubjectMismatch
+	}
+	values := make(map[string]string, len(t.params))
+	for i, token := range tokens {
+		if name := t.names[i]; name != "" {
+			if token == "" {
+				return nil, ErrSubjectMismatch
+			}
+			values[name] = token
+		} else if token != t.tokens[i] {
+			return nil, ErrSubjectMismatch
+		}
+	}
+	return values, nil
+}
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	stringerType        = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+func formatSubjectToken(v reflect.Value) (string, error) {
+	if !v.IsValid() {
+		return "", errors.New("nil value")
+	}
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	if v.Type().Implements(stringerType) {
+		return v.Interface().(fmt.Stringer).String(), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func parseSubjectToken(token string, v reflect.Value) error {
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(token))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(token)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(token, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(token, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(token)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Subject 参数为结构体P的主题模板，字段通过subject标签对应参数，没有标签时按字段名忽略大小写对应
+//
+//	type OrderSubject struct {
+//		Region string `subject:"region"`
+//		Id     int64  `subject:"id"`
+//	}
+//	var OrderCreated = natsx.MustSubject[OrderSubject]("orders.{region}.{id}.created")
+type Subject[P any] struct {
+	template *SubjectTemplate
+	fields   map[string]int
+}
+
+// NewSubject 解析模板并检查每个参数都有对应的字段
+func NewSubject[P any](template string) (*Subject[P], error) {
+	t, err := ParseSubject(template)
+	if err != nil {
+		return nil, err
+	}
+	typ := reflect.TypeOf((*P)(nil)).Elem()
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("natsx: subject parameters must be a struct, got %s", typ)
+	}
+	s := &Subject[P]{template: t, fields: make(map[string]int, len(t.params))}
+	for _, name := range t.params {
+		index := -1
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if tag, ok := field.Tag.Lookup("subject"); ok {
+				if tag == name {
+					index = i
+					break
+				}
+			} else if strings.EqualFold(field.Name, name) {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("natsx: no field in %s for subject parameter %s", typ, name)
+		}
+		s.fields[name] = index
+	}
+	return s, nil
+}
+
+// MustSubject 解析失败时panic，用于包级变量
+func MustSubject[P any](template string) *Subject[P] {
+	s, err := NewSubject[P](template)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Subject[P]) String() string {
+	return s.template.String()
+}
+
+// Template 未绑定类型的模板
+func (s *Subject[P]) Template() *SubjectTemplate {
+	return s.template
+}
+
+// Pattern 所有参数替换为*的订阅主题
+func (s *Subject[P]) Pattern() string {
+	return s.template.Pattern()
+}
+
+// Render 以参数生成主题
+func (s *Subject[P]) Render(params P) (string, error) {
+	values, err := s.values(params, false)
+	if err != nil {
+		return "", err
+	}
+	return s.template.Render(values)
+}
+
+// Filter 零值字段替换为*，其余字段替换为参数值，用于订阅部分参数
+func (s *Subject[P]) Filter(params P) (string, error) {
+	values, err := s.values(params, true)
+	if err != nil {
+		return "", err
+	}
+	return s.template.Filter(values)
+}
+
+func (s *Subject[P]) values(params P, skipZero bool) (map[string]string, error) {
+	v := reflect.ValueOf(params)
+	values := make(map[string]string, len(s.fields))
+	for name, index := range s.fields {
+		field := v.Field(index)
+		if skipZero && field.IsZero() {
+			continue
+		}
+		value, err := formatSubjectToken(field)
+		if err != nil {
+			return nil, fmt.Errorf("natsx: parameter %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Parse 从主题中解析参数，不匹配时返回ErrSubjectMismatch
+func (s *Subject[P]) Parse(subject string) (*P, error) {
+	values, err := s.template.Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+	var params P
+	v := reflect.ValueOf(&params).Elem()
+	for name, index := range s.fields {
+		if err := parseSubjectToken(values[name], v.Field(index)); err != nil {
+			return nil, fmt.Errorf("natsx: parameter %s: %w", name, err)
+		}
+	}
+	return &params, nil
+}
+
+// Handler 解析主题参数后调用fn，解析失败时以400应答请求
+// 如helper.AddNatsCtxHandler(OrderCreated.Pattern(), OrderCreated.Handler(fn))
+func (s *Subject[P]) Handler(fn func(ctx context.Context, params *P, msg *nats.Msg)) MsgHandler {
+	return func(ctx context.Context, msg *nats.Msg) {
+		params, err := s.Parse(msg.Subject)
+		if err != nil {
+			utils.WarningWithCtx(ctx, fmt.Sprintf("failed to parse subject %s with %s: %v", msg.Subject, s.template, err))
+			_ = RespondError(msg, http.StatusBadRequest, err.Error())
+			return
+		}
+		fn(ctx, params, msg)
+	}
+}
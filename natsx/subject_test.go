@@ -0,0 +1,75 @@
+package natsx_test
+
+import (
+	"context"
+	"errors"
+	"github.com/TiyaAnlite/FocotServicesCommon/natsx"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type orderSubject struct {
+	Region string `subject:"region"`
+	Id     int64
+}
+
+var orderCreated = natsx.MustSubject[orderSubject]("orders.{region}.{id}.created")
+
+func TestSubjectTemplate(t *testing.T) {
+	for _, template := range []string{"orders..created", "orders.{id}.{id}", "orders.*", "orders.{}", "orders.a{id}"} {
+		if _, err := natsx.ParseSubject(template); err == nil {
+			t.Errorf("expect %s to be invalid", template)
+		}
+	}
+	tmpl := orderCreated.Template()
+	subject, err := tmpl.Format("eu", 42)
+	if err != nil || subject != "orders.eu.42.created" {
+		t.Fatalf("unexpected subject %s: %v", subject, err)
+	}
+	for _, region := range []string{"", "eu.west", "*", "e u"} {
+		if _, err := tmpl.Render(map[string]string{"region": region, "id": "1"}); err == nil {
+			t.Errorf("expect region %q to be rejected", region)
+		}
+	}
+	if pattern := orderCreated.Pattern(); pattern != "orders.*.*.created" {
+		t.Fatalf("unexpected pattern %s", pattern)
+	}
+	if filter, _ := orderCreated.Filter(orderSubject{Region: "eu"}); filter != "orders.eu.*.created" {
+		t.Fatalf("unexpected filter %s", filter)
+	}
+	if _, err := orderCreated.Parse("orders.eu.42.updated"); !errors.Is(err, natsx.ErrSubjectMismatch) {
+		t.Fatalf("expect mismatch, got %v", err)
+	}
+	if _, err := orderCreated.Parse("orders.eu.x.created"); err == nil {
+		t.Fatal("expect invalid id")
+	}
+	if _, err := natsx.NewSubject[orderSubject]("orders.{user}"); err == nil {
+		t.Fatal("expect missing field")
+	}
+
+	bus := natsx.NewMemoryBus()
+	t.Cleanup(bus.Close)
+	err = bus.AddNatsCtxHandler(orderCreated.Pattern(), orderCreated.Handler(func(ctx context.Context, params *orderSubject, msg *nats.Msg) {
+		_ = natsx.Respond(msg, []byte(params.Region))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err = orderCreated.Render(orderSubject{Region: "us", Id: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	reply, err := bus.RequestCtx(ctx, subject, nil)
+	if err != nil || string(reply.Data) != "us" {
+		t.Fatalf("unexpected reply %v: %v", reply, err)
+	}
+	var serviceErr *natsx.ServiceErr
+	reply, err = bus.RequestCtx(ctx, "orders.us.abc.created", nil)
+	if err != nil || !errors.As(natsx.ServiceError(reply), &serviceErr) || serviceErr.Code != http.StatusBadRequest {
+		t.Fatalf("expect bad request, got %v: %v", reply, err)
+	}
+}
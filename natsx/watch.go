@@ -0,0 +1,103 @@
+package natsx
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog/v2"
+	"sync"
+)
+
+type stopper interface {
+	Stop() error
+}
+
+// watcherSet 管理KV与对象存储的监听器，保证Close时全部停止
+type watcherSet struct {
+	lock     sync.Mutex
+	watchers map[stopper]chan struct{}
+	closed   bool
+}
+
+func (set *watcherSet) add(watcher stopper) (chan struct{}, error) {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if set.closed {
+		_ = watcher.Stop()
+		return nil, nats.ErrConnectionClosed
+	}
+	if set.watchers == nil {
+		set.watchers = make(map[stopper]chan struct{})
+	}
+	done := make(chan struct{})
+	set.watchers[watcher] = done
+	return done, nil
+}
+
+func (set *watcherSet) stop(watcher stopper) {
+	set.lock.Lock()
+	done, ok := set.watchers[watcher]
+	delete(set.watchers, watcher)
+	set.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(done)
+	if err := watcher.Stop(); err != nil {
+		klog.Errorf("failed to stop watcher: %v", err)
+	}
+}
+
+func (set *watcherSet) close() {
+	set.lock.Lock()
+	set.closed = true
+	watchers := make([]stopper, 0, len(set.watchers))
+	for watcher := range set.watchers {
+		watchers = append(watchers, watcher)
+	}
+	set.lock.Unlock()
+	for _, watcher := range watchers {
+		set.stop(watcher)
+	}
+}
+
+// forward 将监听器的更新转换后转发到输出通道，nil更新(初始值结束标记)会被跳过
+// convert返回false时丢弃该条更新
+func forward[In comparable, Out any](ctx context.Context, set *watcherSet, watcher stopper, updates <-chan In, convert func(In) (Out, bool)) (<-chan Out, error) {
+	done, err := set.add(watcher)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Out)
+	go func() {
+		defer close(ch)
+		defer set.stop(watcher)
+		var zero In
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				if update == zero {
+					continue
+				}
+				out, ok := convert(update)
+				if !ok {
+					continue
+				}
+				select {
+				case ch <- out:
+				case <-ctx.Done():
+					return
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}